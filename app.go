@@ -2,14 +2,20 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -21,6 +27,7 @@ import (
 // Unit test hooks
 //
 var websocketInitHook = NewClientWebSocket
+var scanForPlayersHook = sonos.ScanForPlayers
 
 type appState int
 
@@ -32,7 +39,8 @@ const (
 	Listen
 )
 
-func getStateName(state appState) string {
+// String returns the name of the state so the logs are readable
+func (state appState) String() string {
 	var names = map[appState]string{
 		Idle:             "Idle",
 		Searching:        "Searching",
@@ -58,11 +66,30 @@ type ErrorWithId struct {
 	error
 }
 
+// PlayerHistory is what has happened to a player's websocket since we started
+type PlayerHistory struct {
+	Reconnects    uint64     `json:"reconnects"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+
+	connected bool
+}
+
+// ScanStats describes the most recent discovery scan
+type ScanStats struct {
+	Found    int       `json:"found"`
+	Matched  int       `json:"matched"`
+	LastScan time.Time `json:"lastScan"`
+}
+
 // App contains all global state.  Ew.  Needs an interface?
 type App struct {
 	config     Config
 	mqttClient mqtt.Client
 
+	// Builds every player, group and household topic.  See topics.go.
+	topicTemplate *template.Template
+
 	// Current state
 	currentState appState
 
@@ -78,31 +105,148 @@ type App struct {
 	responseChannel chan SonosResponseWithId
 	errorChannel    chan ErrorWithId
 
-	// Groups is a map of every group indexed by PlayerId of the coordinator, and groupsSource
-	// is the PlayerId of the player we subscribed to the groups namespace on.  It is a little
-	// special since we need to switch it if that websocket bounces.
-	groupsLock   sync.RWMutex
-	groups       map[string]Group
-	groupsSource string
-
-	// New map of groups to switch over to when we create websockets
-	groupUpdate map[string]Group
-
-	// Cache of data we sent over MQTT
-	mqttCache map[string]bool
+	// Groups is a map of every group indexed by PlayerId of the coordinator, and groupsSources
+	// are the PlayerIds of the players we subscribed to the groups namespace on.  They are a little
+	// special since we need to switch them if those websockets bounce.
+	groupsLock    sync.RWMutex
+	groups        map[string]Group
+	groupsSources []string
+
+	// Players that failed since the first error in the current ErrorSettle window, and the timer
+	// for that window.  Main goroutine only.
+	erroredPlayers map[string]error
+	errorsTimer    *time.Timer
+
+	// Players we are trying to reconnect on their own, and how many times in a row that has failed.
+	// The timers send the PlayerId to reconnectChannel when it is time to try again.  Main goroutine
+	// only, other than the timers.
+	reconnectAttempts map[string]int
+	reconnectTimers   map[string]*time.Timer
+	reconnectChannel  chan string
+
+	// With more than one groups source every groups event shows up more than once, so we remember
+	// the last one we handled and who sent it.  Main goroutine only.
+	lastGroupsEvent       map[string]Group
+	lastGroupsEventSource string
+
+	// Bumped every time the groups change so clients can tell if they missed an update.  Also
+	// protected by groupsLock.
+	topologySeq uint64
+
+	// The last groups response we got from a player, via REST or an event, before getGroupMap got
+	// its hands on it.  Only kept in debug mode.  Also protected by groupsLock.
+	lastGroupsRaw []byte
+
+	// Groups we are about to switch over to.  They are either waiting for the groups events to
+	// settle down (groupsTimer is running) or for CreateWebsockets to pick them up.  Only touched
+	// on the main goroutine.
+	pendingGroups map[string]Group
+	groupsTimer   *time.Timer
+
+	// How long we've been up, how many times we've started over from discovery, and what has happened
+	// to each player along the way.  Read by the webserver.
+	historyLock   sync.Mutex
+	startTime     time.Time
+	rediscoveries uint64
+	playerHistory map[string]*PlayerHistory
+
+	// Recent REST GET responses for the webserver, indexed by path
+	restCacheLock sync.Mutex
+	restCache     map[string]restCacheEntry
+
+	// Counters for /metrics.  They have their own lock.
+	metrics *Metrics
+
+	// Results of the most recent mDNS scan, and when a scan last found a player, read by the webserver
+	scanLock     sync.RWMutex
+	scanStats    ScanStats
+	lastGoodScan time.Time
+
+	// Copy of currentState for the webserver, updated whenever the main goroutine changes state
+	stateLock     sync.RWMutex
+	reportedState appState
+
+	// Consecutive websocket failures for each player, and the players we have given up on.  Only
+	// touched on the main goroutine.
+	playerFailures map[string]int
+	quarantined    map[string]bool
+
+	// Cache of data we sent over MQTT, and whether publishing is paused.  The webserver can pause
+	// and resume publishing, so these need a lock.  The list keeps the topics in the order they were
+	// last published (most recent first) so we know what to throw out when the cache is full.
+	publishLock       sync.Mutex
+	mqttCache         map[string][]byte
+	mqttCacheOrder    *list.List
+	mqttCacheElements map[string]*list.Element
+	publishPaused     bool
+
+	// Namespaces we have seen for each event type.  Used to warn about types that collide in
+	// the topic paths.
+	eventNamespaces map[string]map[string]bool
+
+	// Rolled up state for each player, and the last version of it we published.  Only touched on
+	// the main goroutine.
+	playerStates      map[string]*PlayerState
+	playerStateBodies map[string][]byte
+
+	// Last playback state for each group coordinator, so we can tell when it changes.  Main goroutine only.
+	groupPlaybackStates map[string]string
+
+	// Namespaces subscribed to at runtime via the webserver, on top of the ones in the config.  They
+	// are added to every rebuild, so they stick until unsubscribed.
+	subscriptionsLock    sync.RWMutex
+	runtimeSubscriptions map[string]bool
+
+	// Number of publishes the broker didn't accept, and when we last complained about it.  Updated
+	// from the goroutines that wait on the publish tokens.
+	publishFailureLock    sync.Mutex
+	publishFailures       uint64
+	lastPublishFailureLog time.Time
+
+	// The last few payloads published to each topic.  Only kept in debug mode, and read from the
+	// webserver so it needs a lock.
+	eventHistoryLock sync.Mutex
+	eventHistory     map[string][][]byte
 }
 
+// Number of payloads we keep per topic in eventHistory
+const eventHistorySize = 8
+
 func NewApp(config Config, client mqtt.Client) *App {
 	return &App{
 		config:          config,
 		mqttClient:      client,
 		currentState:    Idle,
-		responseChannel: make(chan SonosResponseWithId),
-		errorChannel:    make(chan ErrorWithId),
+		responseChannel: make(chan SonosResponseWithId, config.Sonos.EventBuffer),
+		errorChannel:    make(chan ErrorWithId, config.Sonos.EventBuffer),
 		groups:          map[string]Group{},
-		groupsSource:    "",
-		groupUpdate:     map[string]Group{},
-		mqttCache:       map[string]bool{},
+		groupsSources:   nil,
+		erroredPlayers:  map[string]error{},
+		startTime:       time.Now(),
+		playerHistory:   map[string]*PlayerHistory{},
+		restCache:       map[string]restCacheEntry{},
+		playerFailures:  map[string]int{},
+		quarantined:     map[string]bool{},
+		mqttCache:       map[string][]byte{},
+		topicTemplate:   topicTemplateOrDefault(config.MQTT.TopicTemplate),
+		eventHistory:    map[string][][]byte{},
+		eventNamespaces: map[string]map[string]bool{},
+
+		mqttCacheOrder:    list.New(),
+		mqttCacheElements: map[string]*list.Element{},
+
+		runtimeSubscriptions: map[string]bool{},
+
+		playerStates:      map[string]*PlayerState{},
+		playerStateBodies: map[string][]byte{},
+
+		groupPlaybackStates: map[string]string{},
+
+		reconnectAttempts: map[string]int{},
+		reconnectTimers:   map[string]*time.Timer{},
+		reconnectChannel:  make(chan string, 64),
+
+		metrics: newMetrics(),
 	}
 }
 
@@ -110,14 +254,24 @@ func (app *App) run() {
 
 	lastState := app.currentState
 
+	if app.mqttClient != nil {
+		app.publishFormat()
+		app.clearStale()
+		app.subscribeCommands()
+	}
+
 	//
 	// Spin forever, because we have nothing better to do
 	//
 	for {
 
 		if lastState != app.currentState {
-			log.Infof("app: state change: %s -> %s", getStateName(lastState), getStateName(app.currentState))
+			log.Infof("app: state change: %s -> %s", lastState, app.currentState)
 			lastState = app.currentState
+
+			app.stateLock.Lock()
+			app.reportedState = app.currentState
+			app.stateLock.Unlock()
 		}
 
 		switch app.currentState {
@@ -127,12 +281,18 @@ func (app *App) run() {
 		case Searching:
 			var err error = fmt.Errorf("timeout")
 
+			app.historyLock.Lock()
+			app.rediscoveries = app.rediscoveries + 1
+			app.historyLock.Unlock()
+
 			if player := app.discoverPlayer(); player != nil {
 				var response sonos.GroupsResponse
+				var groups map[string]Group
 
 				log.Debugf("found: %s", player.String())
-				if response, err = app.getGroupsRest(player); err == nil {
-					if app.groupUpdate, err = getGroupMap(player.GetHouseholdId(), response); err == nil {
+				if response, err = app.getGroupsRestWithRetry(player); err == nil {
+					if groups, err = getGroupMap(player.GetHouseholdId(), response, app.config.Sonos.MaxPlayers); err == nil {
+						app.pendingGroups = groups
 						app.currentState = CreateWebsockets
 					}
 				}
@@ -154,18 +314,18 @@ func (app *App) run() {
 
 			// Prepare to switch over to the new group list
 			app.groupsLock.Lock()
-			app.groups = app.groupUpdate
+			app.groups = app.pendingGroups
 			app.groupsLock.Unlock()
 
-			app.groupUpdate = nil
+			app.pendingGroups = nil
+
+			app.publishGroupsSnapshot()
+
+			// Errors from the old websockets don't matter any more
+			app.cancelErrors()
 
 			// Empty channels now that the websocket is down and not generating new events
-			for len(app.errorChannel) > 0 {
-				<-app.errorChannel
-			}
-			for len(app.responseChannel) > 0 {
-				<-app.responseChannel
-			}
+			app.drainChannels()
 
 			//
 			// Create websockets and hook up the callbacks
@@ -173,39 +333,69 @@ func (app *App) run() {
 			httpHeaders := http.Header{}
 			app.addApiKey(&httpHeaders)
 
-			first := true
+			openErrors := app.openWebsockets(httpHeaders)
+			if app.refreshAddresses(openErrors) {
+				openErrors = app.openWebsockets(httpHeaders)
+			}
+
+			app.groupsSources = nil
+			app.lastGroupsEvent = nil
+			rescan := false
 
 			// CODEME: I need an easier way to iterate over all players
 			for _, group := range app.groups {
 				for _, player := range group.Players {
 
-					if err := player.InitWebsocketConnection(httpHeaders, app); err != nil {
-						log.Errorf("app: Unable to open websocket for %s: %s", player.GetId(), err.Error())
+					if app.quarantined[player.GetId()] {
+						log.Debugf("app: skipping quarantined player %s", player.GetId())
 						continue
 					}
 
-					// Only subscribe to groups on one player.  It does not need to be a coordinator
-					if first {
-						first = false
-						app.groupsSource = player.GetId()
-						player.SendCommandViaWebsocket("groups", "subscribe", nil)
+					if err := openErrors[player.GetId()]; err != nil {
+						log.Errorf("app: Unable to open websocket for %s: %s", player.GetId(), err.Error())
+						app.publishAvailability(group, player.GetId(), err)
+						app.playerFailed(player.GetId(), err)
+						continue
 					}
 
-					// Subscribe to the list of namespaces provided in the config file on
-					// all group coordinators.  We probably want lists for:
-					//
-					// 1) Global stuff (in the first section above)
-					// 2) Stuff for all group coordinators
-					// 3) Stuff for all players (networking status, whatever)
-					if group.Coordinator.GetId() == player.GetId() {
-						for _, namespace := range app.config.Sonos.Subscriptions.Group {
-							player.SendCommandViaWebsocket(namespace, "subscribe", nil)
+					// Only subscribe to groups on GroupsSources players.  They do not need to be coordinators.
+					// If one fails we just try the next one.
+					if len(app.groupsSources) < app.config.Sonos.GroupsSources || len(app.groupsSources) == 0 {
+						if err := app.subscribe(player, []string{"groups"}); err == nil {
+							app.groupsSources = append(app.groupsSources, player.GetId())
 						}
 					}
+
+					// A player we can't subscribe on is as good as one we couldn't connect to, so count
+					// it as a failure and rescan.  The failure count keeps us from doing this forever.
+					if err := app.subscribe(player, app.namespacesFor(group, player)); err != nil {
+						log.Errorf("app: Unable to subscribe on %s: %s", player.GetId(), err.Error())
+						app.publishAvailability(group, player.GetId(), err)
+						app.playerFailed(player.GetId(), err)
+						rescan = true
+						continue
+					}
+
+					app.playerConnected(group, player.GetId())
 				}
 			}
 
-			app.currentState = Listen
+			if len(app.groupsSources) == 0 {
+				log.Errorf("app: Unable to subscribe to groups on any player")
+				rescan = true
+			}
+
+			// Groups may have changed, so publish their current state instead of waiting for the
+			// next event from each of them.
+			if app.mqttClient != nil && !rescan {
+				app.publishFetchedState()
+			}
+
+			if rescan {
+				app.currentState = Idle
+			} else {
+				app.currentState = Listen
+			}
 
 		case Listen:
 			for {
@@ -214,7 +404,16 @@ func (app *App) run() {
 					app.handleResponse(msg)
 				case err := <-app.errorChannel:
 					log.Debugf("app: ws error=%s", err.Error())
-					app.currentState = Idle
+					app.publishPlayers(app.groups)
+					app.publishOffline(err.playerId, err.error)
+					app.playerFailed(err.playerId, err.error)
+					app.queueError(err.playerId, err.error)
+				case <-app.errorsSettled():
+					app.handleSettledErrors()
+				case id := <-app.reconnectChannel:
+					app.handleReconnect(id)
+				case <-app.groupsSettled():
+					app.applyGroupsUpdate(app.pendingGroups)
 				}
 				if app.currentState != Listen {
 					break
@@ -224,6 +423,522 @@ func (app *App) run() {
 	}
 }
 
+// namespacesFor returns the namespaces to subscribe to on a player.  We probably want lists for:
+//
+// 1) Global stuff (groups, which is handled separately)
+// 2) Stuff for all group coordinators
+// 3) Stuff for all players (networking status, whatever)
+//
+// Namespaces added at runtime via the webserver are tacked on the end.
+func (app *App) namespacesFor(group Group, player Player) []string {
+	var namespaces []string
+	if group.Coordinator.GetId() == player.GetId() {
+		namespaces = append(namespaces, app.config.Sonos.Subscriptions.Group...)
+	}
+
+	// Player namespaces go to everyone
+	namespaces = append(namespaces, app.config.Sonos.Subscriptions.Player...)
+	return append(namespaces, app.runtimeNamespacesFor(group, player)...)
+}
+
+// queueError waits ErrorSettle milliseconds after the first websocket error before deciding what to do
+// about it, so we can tell a blip on one player from the whole network falling over.  Later errors
+// join the same window rather than extending it.
+func (app *App) queueError(id string, err error) {
+	app.erroredPlayers[id] = err
+
+	settle := time.Duration(app.config.Sonos.ErrorSettle) * time.Millisecond
+	if settle == 0 {
+		app.rebuildAfterErrors()
+		return
+	}
+
+	if app.errorsTimer == nil {
+		app.errorsTimer = time.NewTimer(settle)
+	}
+}
+
+// cancelErrors forgets about any errors we were waiting on, and any players we were trying to reconnect
+func (app *App) cancelErrors() {
+	if app.errorsTimer != nil && !app.errorsTimer.Stop() {
+		<-app.errorsTimer.C
+	}
+	app.errorsTimer = nil
+	app.erroredPlayers = map[string]error{}
+
+	for _, timer := range app.reconnectTimers {
+		timer.Stop()
+	}
+	app.reconnectTimers = map[string]*time.Timer{}
+	app.reconnectAttempts = map[string]int{}
+}
+
+// errorsSettled returns a channel that fires when the error window closes.  Nil (which blocks forever
+// in a select) if there were no errors.
+func (app *App) errorsSettled() <-chan time.Time {
+	if app.errorsTimer == nil {
+		return nil
+	}
+	return app.errorsTimer.C
+}
+
+// handleSettledErrors reconnects the player if it was the only one that failed, and rebuilds everything
+// if more than one did.  A reconnect that doesn't work is retried with a backoff.
+func (app *App) handleSettledErrors() {
+	app.errorsTimer = nil
+
+	if len(app.erroredPlayers) == 1 {
+		for id := range app.erroredPlayers {
+			app.erroredPlayers = map[string]error{}
+
+			// If nobody was watching the groups while it was down we can't trust them any more
+			if app.isLastGroupsSource(id) {
+				log.Infof("app: %s was the last groups source, rebuilding", id)
+				app.rebuildAfterErrors()
+				return
+			}
+
+			app.retryReconnect(id)
+		}
+		return
+	}
+
+	log.Infof("app: %d players failed, rebuilding", len(app.erroredPlayers))
+	app.rebuildAfterErrors()
+}
+
+// isLastGroupsSource returns true if the player is a groups source and none of the others are connected
+func (app *App) isLastGroupsSource(id string) bool {
+	found := false
+	for _, source := range app.groupsSources {
+		if source == id {
+			found = true
+			continue
+		}
+
+		if group, ok := findGroupForPlayer(app.groups, source); ok && group.Players[source].IsWebsocketConnected() {
+			return false
+		}
+	}
+	return found
+}
+
+// Time before the first reconnect retry.  It doubles every time, up to ReconnectBackoffMax.  A var
+// so the tests don't have to wait.
+var reconnectBackoffBase = time.Second
+
+// retryReconnect tries to reconnect a single player.  If it fails we try again later, waiting twice as
+// long each time, and give up and rebuild everything after ReconnectAttempts failures in a row.
+func (app *App) retryReconnect(id string) {
+	err := app.reconnectPlayer(id)
+	if err == nil {
+		log.Infof("app: reconnected %s", id)
+		delete(app.reconnectAttempts, id)
+		app.publishPlayers(app.groups)
+		return
+	}
+
+	attempts := app.reconnectAttempts[id] + 1
+	app.reconnectAttempts[id] = attempts
+	log.Errorf("app: unable to reconnect %s (attempt %d): %s", id, attempts, err.Error())
+
+	if attempts >= app.config.Sonos.ReconnectAttempts {
+		log.Infof("app: giving up on reconnecting %s, rebuilding", id)
+		app.rebuildAfterErrors()
+		return
+	}
+
+	backoff := reconnectBackoffBase << (attempts - 1)
+	limit := time.Duration(app.config.Sonos.ReconnectBackoffMax) * time.Second
+	if limit > 0 && (backoff > limit || backoff <= 0) {
+		backoff = limit
+	}
+
+	app.reconnectTimers[id] = time.AfterFunc(backoff, func() {
+		app.reconnectChannel <- id
+	})
+}
+
+// handleReconnect is called when it is time to retry a reconnect.  Timers that fired just as we
+// cancelled them are ignored.
+func (app *App) handleReconnect(id string) {
+	if _, ok := app.reconnectTimers[id]; !ok {
+		return
+	}
+	delete(app.reconnectTimers, id)
+
+	app.retryReconnect(id)
+}
+
+// rebuildAfterErrors tears it all down and starts over
+func (app *App) rebuildAfterErrors() {
+	app.cancelErrors()
+	app.cancelGroupsUpdate()
+	app.currentState = Idle
+}
+
+// reconnectPlayer opens a new websocket to a single player and subscribes to everything it had
+func (app *App) reconnectPlayer(id string) error {
+	if app.quarantined[id] {
+		return fmt.Errorf("quarantined")
+	}
+
+	group, ok := findGroupForPlayer(app.groups, id)
+	if !ok {
+		return fmt.Errorf("not in any group")
+	}
+	player := group.Players[id]
+
+	// If the old one hasn't gone away yet something odd is going on
+	if player.HasWebsocket() {
+		return fmt.Errorf("old websocket is still open")
+	}
+
+	if err := player.Reconnect(); err != nil {
+		return err
+	}
+
+	namespaces := app.namespacesFor(group, player)
+	for _, source := range app.groupsSources {
+		if source == id {
+			namespaces = append([]string{"groups"}, namespaces...)
+		}
+	}
+
+	if err := app.subscribe(player, namespaces); err != nil {
+		player.CloseWebsocketConnection()
+		return err
+	}
+
+	app.playerConnected(group, id)
+	return nil
+}
+
+// isDuplicateGroupsEvent returns true if a groups event from a player is the one we just handled from
+// another groups source, and remembers it otherwise.
+func (app *App) isDuplicateGroupsEvent(source string, groups map[string]Group) bool {
+	if app.lastGroupsEvent != nil && source != app.lastGroupsEventSource && groupsAreCloseEnoughForMe(app.lastGroupsEvent, groups) {
+		return true
+	}
+
+	app.lastGroupsEvent = groups
+	app.lastGroupsEventSource = source
+	return false
+}
+
+// queueGroupsUpdate switches to a new set of groups once the groups events stop changing for
+// GroupsSettle milliseconds.  Later updates replace earlier ones and restart the clock.
+func (app *App) queueGroupsUpdate(groups map[string]Group) {
+	settle := time.Duration(app.config.Sonos.GroupsSettle) * time.Millisecond
+	if settle == 0 {
+		app.applyGroupsUpdate(groups)
+		return
+	}
+
+	app.pendingGroups = groups
+	if app.groupsTimer == nil {
+		app.groupsTimer = time.NewTimer(settle)
+	} else {
+		if !app.groupsTimer.Stop() {
+			<-app.groupsTimer.C
+		}
+		app.groupsTimer.Reset(settle)
+	}
+}
+
+// cancelGroupsUpdate forgets about any groups update that has not settled yet
+func (app *App) cancelGroupsUpdate() {
+	if app.groupsTimer != nil && !app.groupsTimer.Stop() {
+		<-app.groupsTimer.C
+	}
+	app.groupsTimer = nil
+	app.pendingGroups = nil
+}
+
+// groupsSettled returns a channel that fires when a queued groups update has settled.  Nil (which
+// blocks forever in a select) if nothing is queued.
+func (app *App) groupsSettled() <-chan time.Time {
+	if app.groupsTimer == nil {
+		return nil
+	}
+	return app.groupsTimer.C
+}
+
+// applyGroupsUpdate kicks off the rebuild for a new set of groups
+func (app *App) applyGroupsUpdate(groups map[string]Group) {
+	app.groupsTimer = nil
+
+	// This line is insanely slow...
+	app.RemoveStaleTopics(missingPlayers(app.groups, groups), missingGroups(app.groups, groups))
+	app.clearTopicPrefixes(app.movedTopicPrefixes(groups))
+
+	app.pendingGroups = groups
+	app.currentState = CreateWebsockets
+
+	app.releaseQuarantine(groups)
+
+	app.publishTopologySeq()
+}
+
+// runtimeNamespacesFor returns the namespaces added at runtime that apply to a player.  Player namespaces
+// apply to every player, and the rest only apply to coordinators.
+func (app *App) runtimeNamespacesFor(group Group, player Player) []string {
+	app.subscriptionsLock.RLock()
+	defer app.subscriptionsLock.RUnlock()
+
+	namespaces := make([]string, 0, len(app.runtimeSubscriptions))
+	for namespace := range app.runtimeSubscriptions {
+		if sonos.IsPlayerTargetedCommand(namespace) || group.Coordinator.GetId() == player.GetId() {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// subscribe subscribes to each of the namespaces on the player, stopping at the first one that fails
+func (app *App) subscribe(player Player, namespaces []string) error {
+	for _, namespace := range namespaces {
+		if err := player.SendCommandViaWebsocket(namespace, "subscribe", nil); err != nil {
+			return fmt.Errorf("%s: %s", namespace, err.Error())
+		}
+	}
+	return nil
+}
+
+// openWebsockets opens websockets to all of the players that are not quarantined, a few at a time since
+// each one dials synchronously.  Returns once they have all either connected or failed, with the errors
+// indexed by PlayerId.
+func (app *App) openWebsockets(httpHeaders http.Header) map[string]error {
+	workers := app.config.Sonos.OpenWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	openErrors := map[string]error{}
+	slots := make(chan struct{}, workers)
+
+	for _, group := range app.groups {
+		for _, player := range group.Players {
+			if app.quarantined[player.GetId()] {
+				continue
+			}
+
+			wg.Add(1)
+			go func(player Player) {
+				defer wg.Done()
+
+				slots <- struct{}{}
+				err := player.InitWebsocketConnection(httpHeaders, app)
+				<-slots
+
+				lock.Lock()
+				openErrors[player.GetId()] = err
+				lock.Unlock()
+			}(player)
+		}
+	}
+
+	wg.Wait()
+	return openErrors
+}
+
+// refreshAddresses asks a player we did connect to for the current addresses of the ones we
+// couldn't connect to, in case they moved since we last fetched the groups.  Returns true if any
+// of them did, at which point it is worth trying them again.
+func (app *App) refreshAddresses(openErrors map[string]error) bool {
+	var source Player = nil
+	failed := map[string]Player{}
+
+	for _, group := range app.groups {
+		for id, player := range group.Players {
+			err, tried := openErrors[id]
+			if tried && err != nil {
+				failed[id] = player
+			} else if tried && source == nil {
+				source = player
+			}
+		}
+	}
+
+	if len(failed) == 0 || source == nil {
+		return false
+	}
+
+	response, err := app.getGroupsRest(source)
+	if err != nil {
+		log.Errorf("app: unable to refresh player addresses: %s", err.Error())
+		return false
+	}
+
+	moved := false
+	for _, sonosPlayer := range response.Players {
+		if player, ok := failed[sonosPlayer.Id]; ok && player.UpdateAddress(sonosPlayer.WebsocketUrl) {
+			moved = true
+		}
+	}
+
+	return moved
+}
+
+// Namespaces that belong to the household rather than a group or a player.  Only matters for the
+// fetch list in the config, since these need a different URL.
+var householdNamespaces = map[string]bool{
+	"favorites": true,
+	"playlists": true,
+}
+
+// publishFetchedState grabs the current state of everything in the fetch list and publishes it as if it
+// had been evented, so the topics are filled in right away instead of whenever the next event shows up.
+// Household namespaces are fetched once, player namespaces from every player, and the rest from every
+// group coordinator.
+func (app *App) publishFetchedState() {
+	for _, namespace := range app.config.Sonos.Fetch {
+		for _, group := range app.groups {
+			if householdNamespaces[namespace] {
+				app.publishFetched(group, group.Coordinator, namespace, "", "/"+namespace)
+				break
+			}
+
+			if sonos.IsPlayerTargetedCommand(namespace) {
+				for id, player := range group.Players {
+					app.publishFetched(group, player, namespace, group.Id, fmt.Sprintf("/players/%s/%s", id, namespace))
+				}
+			} else {
+				app.publishFetched(group, group.Coordinator, namespace, group.Id, fmt.Sprintf("/groups/%s/%s", group.Id, namespace))
+			}
+		}
+	}
+}
+
+// publishFetched does a GET for one namespace on one player and publishes it.  The type is whatever
+// Sonos says it is in _objectType, which is what it would have used had it evented the same data.
+func (app *App) publishFetched(group Group, player Player, namespace string, groupId string, path string) {
+	body, err := app.playerDoGET(player, path)
+	if err != nil {
+		log.Errorf("app: unable to get %s for %s: %s", namespace, player.GetId(), err.Error())
+		return
+	}
+
+	objectType := struct {
+		ObjectType string `json:"_objectType"`
+	}{}
+	if json.Unmarshal(body, &objectType) != nil || objectType.ObjectType == "" {
+		objectType.ObjectType = namespace
+	}
+
+	msg := SonosResponseWithId{
+		playerId: player.GetId(),
+		WebsocketResponse: sonos.WebsocketResponse{
+			Headers: sonos.ResponseHeaders{
+				CommonHeaders: sonos.CommonHeaders{
+					Namespace:   namespace,
+					HouseholdId: player.GetHouseholdId(),
+					GroupId:     groupId,
+				},
+				Type: objectType.ObjectType,
+			},
+			BodyJSON: body,
+		},
+	}
+
+	app.updatePlayerStates(group, &msg)
+
+	if app.config.Sonos.Simplify {
+		simplifySonosType(&msg, group.Coordinator)
+	}
+
+	app.PublishEventToAllTopics(group, &msg)
+}
+
+// playerFailed counts a websocket failure for the player, and quarantines it once it hits the
+// configured limit so a dead player doesn't keep us rebuilding everything forever.
+func (app *App) playerFailed(id string, err error) {
+	app.historyLock.Lock()
+	history := app.playerHistoryFor(id)
+	history.LastError = err.Error()
+	now := time.Now()
+	history.LastErrorTime = &now
+	app.historyLock.Unlock()
+
+	if app.config.Sonos.MaxFailures == 0 || app.quarantined[id] {
+		return
+	}
+
+	app.playerFailures[id] = app.playerFailures[id] + 1
+	if app.playerFailures[id] >= app.config.Sonos.MaxFailures {
+		log.Errorf("app: quarantining %s after %d failures", id, app.playerFailures[id])
+		app.quarantined[id] = true
+		delete(app.playerFailures, id)
+	}
+}
+
+// playerConnected is called once a player has a websocket and is subscribed.  Opening a websocket to a
+// player we have connected to before counts as a reconnect.
+func (app *App) playerConnected(group Group, id string) {
+	delete(app.playerFailures, id)
+	app.publishAvailability(group, id, nil)
+
+	app.historyLock.Lock()
+	history := app.playerHistoryFor(id)
+	if history.connected {
+		history.Reconnects = history.Reconnects + 1
+	}
+	history.connected = true
+	app.historyLock.Unlock()
+}
+
+// playerHistoryFor returns the history for a player, creating it if needed.  Must be called with
+// historyLock held.
+func (app *App) playerHistoryFor(id string) *PlayerHistory {
+	history, ok := app.playerHistory[id]
+	if !ok {
+		history = &PlayerHistory{}
+		app.playerHistory[id] = history
+	}
+	return history
+}
+
+// releaseQuarantine forgets about quarantined players that have dropped out of the groups, so that they
+// get a fresh start if a later topology change brings them back.
+func (app *App) releaseQuarantine(groups map[string]Group) {
+	players := getPlayers(groups)
+
+	for id := range app.quarantined {
+		if _, ok := players[id]; !ok {
+			log.Infof("app: releasing %s from quarantine", id)
+			delete(app.quarantined, id)
+		}
+	}
+}
+
+// Shutdown gives outstanding commands up to drainTime to complete and then closes all of the websockets.
+// Anything still outstanding after that is failed when the websocket closes.
+func (app *App) Shutdown(drainTime time.Duration) {
+	app.groupsLock.RLock()
+	players := make([]Player, 0, 64)
+	for _, group := range app.groups {
+		for _, player := range group.Players {
+			players = append(players, player)
+		}
+	}
+	app.groupsLock.RUnlock()
+
+	deadline := time.Now().Add(drainTime)
+	for _, player := range players {
+		player.DrainCommands(time.Until(deadline))
+	}
+
+	for _, player := range players {
+		player.CloseWebsocketConnection()
+	}
+
+	// Wait for these since we are about to disconnect
+	app.publishStale()
+	app.clearHassDiscovery()
+}
+
 // handleResponse is run on the main goroutine so it can muck with the state machine. Yup,
 // the entire state machine needs to go, and this should simply return a new groupsMap if
 // we have one instead of kicking the state machine here.
@@ -234,9 +949,10 @@ func (app *App) handleResponse(msg SonosResponseWithId) {
 		log.Debugf("app: subscribed to %s: %s", msg.Headers.Namespace, msg.playerId)
 		return
 	}
+	app.metrics.countEvent(msg.Headers.Namespace)
 
-	// Look up the group
-	group, ok := app.groups[msg.playerId]
+	// Look up the group.  Player events can come from any player, not just the coordinator.
+	group, ok := findGroupForPlayer(app.groups, msg.playerId)
 	if !ok {
 		log.Errorf("app: handleResponse: unknown player: %s", msg.playerId)
 		return
@@ -248,10 +964,16 @@ func (app *App) handleResponse(msg SonosResponseWithId) {
 		return
 	}
 
+	app.checkEventNamespace(msg.Headers.Namespace, msg.Headers.Type)
+	app.invalidateREST(msg.Headers.Namespace)
+
 	//
 	// Process the ones we care about.  Only one for now.
 	//
-	publishPlayers := false
+	//
+	// latestGroups is set to what the groups event says the world looks like, which is what we
+	// publish as the players.  It may not be what we are currently connected to.
+	var latestGroups map[string]Group = nil
 	if msg.Headers.Type == "groups" {
 
 		// Make sure we can parse it
@@ -259,23 +981,32 @@ func (app *App) handleResponse(msg SonosResponseWithId) {
 		if err := json.Unmarshal(msg.BodyJSON, &groupsResponse); err != nil {
 			return
 		}
+		app.recordGroupsRaw(msg.BodyJSON)
 
 		player := group.Coordinator
 		log.Infof("app: groups event: player=%s", player.GetName())
 
-		// If the list of groups is different, kick the main state machine so we can connect to all of the correct players
-		if groups, err := getGroupMap(player.GetHouseholdId(), groupsResponse); err == nil {
-			if !groupsAreCloseEnoughForMe(app.groups, groups) {
-				// This line is insanely slow...
-				app.RemoveStaleTopics(missingPlayers(app.groups, groups), missingGroups(app.groups, groups))
+		// If the list of groups is different, kick the main state machine so we can connect to all of the correct players.
+		// Regrouping sends a flurry of these, so wait for them to settle down first.  If we end up back where we
+		// started there is nothing to do.
+		groups, err := getGroupMap(player.GetHouseholdId(), groupsResponse, app.config.Sonos.MaxPlayers)
 
-				app.groupUpdate = groups
-				app.currentState = CreateWebsockets
-			}
+		// The same event from another groups source is old news
+		if err == nil && app.isDuplicateGroupsEvent(msg.playerId, groups) {
+			log.Debugf("app: duplicate groups event from %s", msg.playerId)
+			return
+		}
+
+		if err != nil {
+			groups = app.groups
+		} else if !groupsAreCloseEnoughForMe(app.groups, groups) {
+			app.queueGroupsUpdate(groups)
+		} else {
+			app.cancelGroupsUpdate()
 		}
 
 		// Always publish the players when we publish the groups
-		publishPlayers = true
+		latestGroups = groups
 	}
 
 	// Pretty sure we can blindly fan out any events have a groupid to the group?  I guess this means:
@@ -291,111 +1022,497 @@ func (app *App) handleResponse(msg SonosResponseWithId) {
 	//       change.
 	log.Debugf("app: handleResponse: id=%s: namespace=%s, type=%s, hhid=%s, groupid=%s", msg.playerId, msg.Headers.Namespace, msg.Headers.Type, msg.Headers.HouseholdId, msg.Headers.GroupId)
 
+	// Roll it up into the player state before simplifying mangles it
+	app.updatePlayerStates(group, &msg)
+	if app.config.Sonos.Transitions {
+		app.checkPlaybackTransition(group, &msg)
+	}
+
 	if app.mqttClient != nil {
 
 		// Simplify?
 		if app.config.Sonos.Simplify {
-			simplifySonosType(&msg)
+			simplifySonosType(&msg, group.Coordinator)
 		}
 
 		app.PublishEventToAllTopics(group, &msg)
 
-		// Publish players if needed.  A little tricky the first time around since we
-		// always get an event even though we grabbed the groups via REST before
-		// we subscribed.  This means that the first time through the right map
-		// is app.groups.
-		//
-		// I really need to refactor all of this and dump app.groupUpdate entirely.
-		if publishPlayers {
-			groups := &app.groups
-			if len(app.groupUpdate) != 0 {
-				groups = &app.groupUpdate
-			}
-			hhPath := fmt.Sprintf("%s/%s", app.config.MQTT.Topic, "players")
-			bytes, _ := getPlayersJSONFromGroupMap(*groups)
-			app.PublishEventToTopic(hhPath, bytes)
+		// Publish players if needed.  We always get an event right after subscribing even
+		// though we grabbed the groups via REST first, but the event is the truth either way.
+		if latestGroups != nil {
+			app.publishPlayers(latestGroups)
+			app.publishHassDiscovery(latestGroups)
 		}
 	}
 }
 
+// checkEventNamespace warns if we see the same event type in more than one namespace, since those
+// events end up on the same topic unless the namespace is in the path.
+func (app *App) checkEventNamespace(namespace string, eventType string) {
+	namespaces, ok := app.eventNamespaces[eventType]
+	if !ok {
+		namespaces = map[string]bool{}
+		app.eventNamespaces[eventType] = namespaces
+	}
+
+	if namespaces[namespace] {
+		return
+	}
+	namespaces[namespace] = true
+
+	if len(namespaces) > 1 && !app.config.MQTT.NamespaceInPath {
+		log.Warnf("app: event type %s seen in multiple namespaces (latest %s).  Consider setting namespaceinpath.", eventType, namespace)
+	}
+}
+
 func (app *App) PublishEventToAllTopics(group Group, msg *SonosResponseWithId) {
 
-	// Paths
+	// Paths, with the default topic template (see topics.go)
 	//
 	// Household events:
-	//   {app.config.MQTT.Topic}/v1/events/{msg.Headers.Type}
+	//   {app.config.MQTT.Topic}/{msg.Headers.Type}
 	//
 	// Group events:
 	//   Fanout disabled:
-	//     {app.config.MQTT.Topic}/v1/events/group/{coordinatorId}/{msg.Headers.Type}
+	//     {app.config.MQTT.Topic}/group/{coordinatorId}/{msg.Headers.Type}
 	//   Fanout enabled:
-	//     {app.config.MQTT.Topic}/v1/events/player/{playerIdForEachPlayerInGroup}/{msg.Headers.Type}
+	//     {app.config.MQTT.Topic}/player/{playerIdForEachPlayerInGroup}/{msg.Headers.Type}
 	//
-	// Player events (eventually):
-	//     {app.config.MQTT.Topic}/v1/events/player/{playerId}/{msg.Headers.Type}
+	// Player events:
+	//     {app.config.MQTT.Topic}/player/{playerId}/{msg.Headers.Type}
 	//
-	// NOTE: This currently assumes that namespace does not really matter for events.  More
+	// NOTE: By default this assumes that namespace does not really matter for events.  More
 	//       specifically that there are no Types with the same name in different namespaces
 	//       unless they are really the same Type.  Probably a bad assumption, but it cleans
-	//       up the paths a bit.  We can always add {msg.Headers.Namespace} back in the path
-	//       if we care.
-	if msg.Headers.GroupId == "" {
-		hhPath := fmt.Sprintf("%s/%s", app.config.MQTT.Topic, msg.Headers.Type)
-		app.PublishEventToTopic(hhPath, msg.BodyJSON)
+	//       up the paths a bit.  Setting namespaceinpath in the config turns {msg.Headers.Type}
+	//       into {msg.Headers.Namespace}/{msg.Headers.Type} for those that care.
+	eventPath := app.eventPath(msg)
+
+	if app.config.MQTT.SkipEmpty && isEmptyBody(msg.BodyJSON) {
+		log.Debugf("app: skipping empty %s", eventPath)
+		return
+	}
+
+	body, err := app.eventPayload(msg)
+	if err != nil {
+		log.Errorf("app: unable to build payload for %s: %s", eventPath, err.Error())
+		return
+	}
+
+	namespace := msg.Headers.Namespace
+	if sonos.IsPlayerTargetedCommand(namespace) {
+		app.PublishEventToTopic(app.topicFor("player", msg.playerId, namespace, eventPath), body)
+	} else if msg.Headers.GroupId == "" {
+		app.PublishEventToTopic(app.topicFor("", "", namespace, eventPath), body)
 	} else {
-		groupPath := fmt.Sprintf("%s/group/%s/%s", app.config.MQTT.Topic, group.Coordinator.GetId(), msg.Headers.Type)
-		app.PublishEventToTopic(groupPath, msg.BodyJSON)
+		app.PublishEventToTopic(app.topicFor("group", group.Coordinator.GetId(), namespace, eventPath), body)
 		if app.config.Sonos.FanOut {
 			for _, player := range group.Players {
-				playerPath := fmt.Sprintf("%s/player/%s/%s", app.config.MQTT.Topic, player.GetId(), msg.Headers.Type)
-				app.PublishEventToTopic(playerPath, msg.BodyJSON)
+				app.PublishEventToTopic(app.topicFor("player", player.GetId(), namespace, eventPath), body)
 			}
 		}
 	}
 }
 
+// EventEnvelope is what we publish instead of the bare body when envelope is set in the config
+type EventEnvelope struct {
+	Headers sonos.ResponseHeaders `json:"headers"`
+	Body    json.RawMessage       `json:"body"`
+}
+
+// eventPayload returns what we publish for an event, which is either the body or the body wrapped
+// up with the headers
+func (app *App) eventPayload(msg *SonosResponseWithId) ([]byte, error) {
+	if !app.config.MQTT.Envelope {
+		return msg.BodyJSON, nil
+	}
+
+	body := msg.BodyJSON
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+
+	return json.Marshal(EventEnvelope{Headers: msg.Headers, Body: body})
+}
+
+// isEmptyBody returns true if the body is nothing, whitespace, or an empty object
+func isEmptyBody(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return true
+	}
+
+	if trimmed[0] != '{' {
+		return false
+	}
+
+	object := map[string]json.RawMessage{}
+	return json.Unmarshal(trimmed, &object) == nil && len(object) == 0
+}
+
+// eventPath returns the last part of the topic for an event, which is the type and optionally the namespace
+func (app *App) eventPath(msg *SonosResponseWithId) string {
+	if app.config.MQTT.NamespaceInPath {
+		return fmt.Sprintf("%s/%s", msg.Headers.Namespace, msg.Headers.Type)
+	}
+	return msg.Headers.Type
+}
+
 // PublishEventToTopic publishes a byte slice to a single MQTT topic.  It also keeps track of the topics
 // we have published to so we can clear them later as needed.
 func (app *App) PublishEventToTopic(topic string, body []byte) {
 
+	// Keep a surprise event type from creating a topic the broker ACLs don't expect
+	if !app.isTopicPublishable(topic) {
+		log.Infof("app: not allowed to publish to %s", topic)
+		return
+	}
+
+	// Convert before caching so a resume republishes the right thing.  History stays JSON for the API.
+	payload := app.formatPayload(topic, body)
+
+	app.publishLock.Lock()
+	defer app.publishLock.Unlock()
+
+	// Same thing we sent last time?  If it's retained, anyone subscribing later still gets it from the
+	// broker, so nobody needs to see it again.  Non-retained topics always go out.
+	qos, retain := app.publishOptionsForTopic(topic)
+	last, seen := app.mqttCache[topic]
+	duplicate := app.config.MQTT.Dedup && retain && seen && bytes.Equal(last, payload)
+
 	// Stash it.  Memory is cheap.
-	app.mqttCache[topic] = true
+	app.cacheTopic(topic, payload)
+
+	if duplicate {
+		return
+	}
+
+	// Paused?  We'll publish whatever is in the cache when we resume.
+	if app.publishPaused {
+		return
+	}
+
+	if app.config.Debug {
+		app.recordEvent(topic, body)
+	}
 
 	// Publish
 	//
-	// NOTE: We currently send this at a QoS of 1 and retain.  Retaining is a pain, and in part why we
+	// NOTE: By default we send this at a QoS of 1 and retain.  Retaining is a pain, and in part why we
 	//       have the cache.  If we dump retain and add a method for refreshing the content when a new
 	//       device connects (likely via the device eventing), we can skip retain.  The downside is that
-	//       every subscriber will get a full data dump when a new subscriber is added.
+	//       every subscriber will get a full data dump when a new subscriber is added.  The qos config
+	//       can turn retain off for topics where stale data is worse than no data.
 	// log.Debugf("app: cache miss: %s", topic)
-	app.mqttClient.Publish(topic, 1, true, body)
+	app.checkPublish(topic, app.mqttClient.Publish(topic, qos, retain, payload))
 }
 
-//
+// publishTransient publishes something that only makes sense right now, like a transition.  It is not
+// retained or cached, so it is not republished on resume, and it is dropped while paused.
+func (app *App) publishTransient(topic string, body []byte) {
+	if !app.isTopicPublishable(topic) {
+		log.Infof("app: not allowed to publish to %s", topic)
+		return
+	}
+
+	payload := app.formatPayload(topic, body)
+
+	app.publishLock.Lock()
+	defer app.publishLock.Unlock()
+
+	if app.publishPaused {
+		return
+	}
+
+	if app.config.Debug {
+		app.recordEvent(topic, body)
+	}
+
+	app.checkPublish(topic, app.mqttClient.Publish(topic, app.qosForTopic(topic), false, payload))
+}
+
+// formatPayload converts the JSON body to the configured format
+func (app *App) formatPayload(topic string, body []byte) []byte {
+	if app.config.MQTT.Format != "msgpack" || len(body) == 0 || app.isHassTopic(topic) {
+		return body
+	}
+
+	payload, err := jsonToMsgpack(body)
+	if err != nil {
+		log.Debugf("app: not converting %s to msgpack: %s", topic, err.Error())
+		return body
+	}
+	return payload
+}
+
+// cacheTopic adds or updates a topic in the cache, and evicts the least recently published topics if
+// that makes the cache too big.  Evicted topics are cleared on the broker, since we would not be able to
+// clear them later when they go stale.  Must be called with publishLock held.
+func (app *App) cacheTopic(topic string, body []byte) {
+	app.mqttCache[topic] = body
+
+	if element, ok := app.mqttCacheElements[topic]; ok {
+		app.mqttCacheOrder.MoveToFront(element)
+	} else {
+		app.mqttCacheElements[topic] = app.mqttCacheOrder.PushFront(topic)
+	}
+
+	limit := app.config.MQTT.CacheSize
+	for limit > 0 && len(app.mqttCache) > limit {
+		oldest := app.mqttCacheOrder.Back().Value.(string)
+		app.uncacheTopic(oldest)
+
+		// If we're paused the clear has nowhere to go, so the broker keeps whatever it had
+		log.Infof("app: cache full, evicting %s", oldest)
+		if !app.publishPaused && app.mqttClient != nil {
+			qos, retain := app.publishOptionsForTopic(oldest)
+			app.checkPublish(oldest, app.mqttClient.Publish(oldest, qos, retain, ""))
+		}
+	}
+}
+
+// uncacheTopic removes a topic from the cache.  Must be called with publishLock held.
+func (app *App) uncacheTopic(topic string) {
+	delete(app.mqttCache, topic)
+	if element, ok := app.mqttCacheElements[topic]; ok {
+		app.mqttCacheOrder.Remove(element)
+		delete(app.mqttCacheElements, topic)
+	}
+}
+
+// publishFormat tells subscribers what the payloads look like.  It goes straight to the broker since
+// it is not JSON and should never be converted.
+func (app *App) publishFormat() {
+	format := app.config.MQTT.Format
+	if format == "" {
+		format = "json"
+	}
+
+	topic := fmt.Sprintf("%s/format", app.config.MQTT.Topic)
+	app.checkPublish(topic, app.mqttClient.Publish(topic, 1, true, format))
+}
+
+// How long we wait for the broker to accept a publish before calling it a failure
+const publishTimeout = 10 * time.Second
+
+// checkPublish waits for a publish to complete in the background and counts it if it failed.  Failures
+// are logged at most once every FailureLogInterval seconds, with a count of the ones we kept quiet about.
+func (app *App) checkPublish(topic string, token mqtt.Token) {
+	app.metrics.countPublish()
+
+	go func() {
+		var err error
+		if !token.WaitTimeout(publishTimeout) {
+			err = fmt.Errorf("timed out")
+		} else if err = token.Error(); err == nil {
+			return
+		}
+
+		app.publishFailureLock.Lock()
+		defer app.publishFailureLock.Unlock()
+
+		app.publishFailures = app.publishFailures + 1
+
+		interval := time.Duration(app.config.MQTT.FailureLogInterval) * time.Second
+		if interval == 0 || time.Since(app.lastPublishFailureLog) < interval {
+			return
+		}
+
+		log.Errorf("app: publish to %s failed: %s (%d failures so far)", topic, err.Error(), app.publishFailures)
+		app.lastPublishFailureLog = time.Now()
+	}()
+}
+
+// isTopicPublishable returns true if the topic matches one of the allowed patterns, or if there are none
+func (app *App) isTopicPublishable(topic string) bool {
+	if len(app.config.MQTT.Allow) == 0 {
+		return true
+	}
+
+	for _, pattern := range app.config.MQTT.Allow {
+		if match, _ := path.Match(pattern, topic); match {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEvent adds the payload to the history for the topic, dropping the oldest one if the history is full.
+func (app *App) recordEvent(topic string, body []byte) {
+	app.eventHistoryLock.Lock()
+	defer app.eventHistoryLock.Unlock()
+
+	history := app.eventHistory[topic]
+	if len(history) >= eventHistorySize {
+		history = history[1:]
+	}
+	app.eventHistory[topic] = append(history, body)
+}
+
+// publishOptionsForTopic returns the QoS and retain flag for the first configured rule that matches the
+// topic, or QoS 1 and retained if nothing matches.  This lets chatty topics (position, volume) go out at
+// QoS 0 and not retained, while state stays at QoS 1 and retained.
+func (app *App) publishOptionsForTopic(topic string) (byte, bool) {
+	eventType := path.Base(topic)
+
+	for _, q := range app.config.MQTT.QoS {
+		if q.Pattern != "" {
+			if match, _ := path.Match(q.Pattern, topic); !match {
+				continue
+			}
+		}
+		if q.Type != "" {
+			if match, _ := path.Match(q.Type, eventType); !match {
+				continue
+			}
+		}
+
+		retain := app.config.MQTT.Retain
+		if q.Retain != nil {
+			retain = *q.Retain
+		}
+		return q.QoS, retain
+	}
+	return app.config.MQTT.DefaultQoS, app.config.MQTT.Retain
+}
+
+// qosForTopic is publishOptionsForTopic for when we only care about the QoS
+func (app *App) qosForTopic(topic string) byte {
+	qos, _ := app.publishOptionsForTopic(topic)
+	return qos
+}
+
+// publishGroupsSnapshot publishes the groups we are actually connected to, so late subscribers can get the
+// whole topology without waiting for it to change.  It is not {base}/groups since that is where the groups
+// event itself goes.  Main goroutine only, since it reads app.groups without the lock.
+func (app *App) publishGroupsSnapshot() {
+	if app.mqttClient == nil {
+		return
+	}
+
+	body, err := json.Marshal(exportedGroups(app.groups))
+	if err != nil {
+		log.Errorf("app: unable to marshal groups snapshot: %s", err.Error())
+		return
+	}
+
+	app.PublishEventToTopic(fmt.Sprintf("%s/topology/groups", app.config.MQTT.Topic), body)
+}
+
+// publishTopologySeq bumps the topology sequence number and publishes it.  Clients that see a gap
+// in the sequence know that they missed a groups update and should fetch them again.
+func (app *App) publishTopologySeq() {
+	app.groupsLock.Lock()
+	app.topologySeq = app.topologySeq + 1
+	seq := app.topologySeq
+	app.groupsLock.Unlock()
+
+	if app.mqttClient != nil {
+		seqPath := fmt.Sprintf("%s/topology/seq", app.config.MQTT.Topic)
+		app.PublishEventToTopic(seqPath, []byte(fmt.Sprintf("%d", seq)))
+	}
+}
+
+// RemoveStaleTopics clears everything we published for players and groups that went away.  The clears
+// are retained, or the broker would keep handing the old retained payloads to new subscribers.
 func (app *App) RemoveStaleTopics(players []string, groups []string) {
 	var prefixes []string = make([]string, 0, 32)
 
+	// The prefix runs up to the type, so with the default template the trailing slash keeps P1 from
+	// matching P10
 	for _, player := range players {
-		prefixes = append(prefixes, fmt.Sprintf("%s/v1/events/player/%s", app.config.MQTT.Topic, player))
+		prefixes = append(prefixes, app.topicPrefix("player", player))
+		if app.config.Sonos.HassDiscovery {
+			prefixes = append(prefixes, app.hassTopic(player))
+		}
 	}
 
 	for _, group := range groups {
-		prefixes = append(prefixes, fmt.Sprintf("%s/v1/events/group/%s", app.config.MQTT.Topic, group))
+		prefixes = append(prefixes, app.topicPrefix("group", group))
+	}
+
+	app.clearTopicPrefixes(prefixes)
+}
+
+// clearTopicPrefixes clears every cached topic that starts with one of the prefixes
+func (app *App) clearTopicPrefixes(prefixes []string) {
+	if len(prefixes) == 0 {
+		return
 	}
 
 	log.Infof("app: prefixes: %s", strings.Join(prefixes, ","))
+
+	app.publishLock.Lock()
+	defer app.publishLock.Unlock()
+
 	for topic := range app.mqttCache {
 		for _, prefix := range prefixes {
 			if strings.HasPrefix(topic, prefix) {
 				log.Infof("app: clearing %s", topic)
-				delete(app.mqttCache, topic)
-				app.mqttClient.Publish(topic, 1, false, "")
+
+				// If we're paused, leave an empty body in the cache so the clear goes out on resume
+				if app.publishPaused {
+					app.mqttCache[topic] = []byte{}
+				} else {
+					app.uncacheTopic(topic)
+					qos, retain := app.publishOptionsForTopic(topic)
+					app.checkPublish(topic, app.mqttClient.Publish(topic, qos, retain, ""))
+				}
 				break
 			}
 		}
 	}
 }
 
+// SetPublishingPaused stops or restarts publishing to MQTT.  The cache is still updated while
+// paused, and everything in it is published on resume so the broker catches up with reality.
+func (app *App) SetPublishingPaused(paused bool) {
+	app.publishLock.Lock()
+	defer app.publishLock.Unlock()
+
+	if app.publishPaused == paused {
+		return
+	}
+
+	app.publishPaused = paused
+	if paused || app.mqttClient == nil {
+		log.Infof("app: publishing paused=%t", paused)
+		return
+	}
+
+	log.Infof("app: publishing resumed, sending %d cached topics", len(app.mqttCache))
+	for topic, body := range app.mqttCache {
+		// Empty bodies are stale topics that were cleared while we were paused
+		if len(body) == 0 {
+			app.uncacheTopic(topic)
+		} else if app.config.Debug && app.config.MQTT.Format != "msgpack" {
+			app.recordEvent(topic, body)
+		}
+
+		qos, retain := app.publishOptionsForTopic(topic)
+		app.checkPublish(topic, app.mqttClient.Publish(topic, qos, retain, body))
+	}
+}
+
+// drainChannels throws away everything queued up on the response and error channels.  Checking len() in a
+// loop doesn't work, since it is always 0 for an unbuffered channel and can race with a sender on a
+// buffered one, so keep going until a receive would block.
+func (app *App) drainChannels() {
+	dropped := 0
+	for {
+		select {
+		case <-app.responseChannel:
+		case <-app.errorChannel:
+		default:
+			if dropped > 0 {
+				log.Debugf("app: dropped %d stale events and errors", dropped)
+			}
+			return
+		}
+		dropped = dropped + 1
+	}
+}
+
 //
 // All of On* callbacks are run in the websocket's goroutines
 //
@@ -403,6 +1520,16 @@ func (app *App) RemoveStaleTopics(players []string, groups []string) {
 // OnError is called when a websocket error has occurred.  This is run in a goroutine
 // owned by the websocket.
 func (app *App) OnError(id string, err error) {
+	// A player that closes the websocket on purpose is usually rebooting.  It gets the same treatment as
+	// any other error, but it is nice to know the difference when reading the logs.
+	var reason CloseReason
+	if errors.As(err, &reason) && reason.IsNormal() {
+		log.Infof("app: %s: player closed the websocket (%s), probably rebooting", id, reason.Error())
+	} else {
+		log.Infof("app: %s: websocket error: %s", id, err.Error())
+	}
+
+	app.metrics.countWebsocketError()
 	app.errorChannel <- ErrorWithId{
 		playerId: id,
 		error:    err,
@@ -432,13 +1559,30 @@ func (app *App) discoverPlayer() Player {
 	// Create a channel to collect responses
 	var responseChannel chan sonos.DiscoveryData = make(chan sonos.DiscoveryData, 32)
 
+	// Reset the stats for this scan
+	app.scanLock.Lock()
+	app.scanStats = ScanStats{LastScan: time.Now()}
+	app.scanLock.Unlock()
+
 	// Kick off the discovery process
-	sonos.ScanForPlayers(ctx, responseChannel)
+	scanForPlayersHook(ctx, responseChannel)
+
+	// Wait for responses to come in until the scan time is up.  Note that the discovery code is running on
+	// a different goroutine, so we can block here if we'd like.  We keep the first player that answers
+	// /info, but keep draining so the scan stats count everything that responded.  At some point I'll
+	// kick off multiple REST attempts at a time, but not today.  It doesn't beat on the network.
+	for {
+		var response sonos.DiscoveryData
+		select {
+		case response = <-responseChannel:
+		case <-ctx.Done():
+			return player
+		}
 
-	// Wait for responses to come in.  Note that the discovery code is running on a different goroutine,
-	// so we can block here if we'd like.  At some point I'll kick off multiple REST attempts at a time,
-	// but not today.  This makes discovery nearly instant as it is, and it doesn't beat on the network.
-	for response := range responseChannel {
+		app.scanLock.Lock()
+		app.scanStats.Found = app.scanStats.Found + 1
+		app.scanLock.Unlock()
+		app.metrics.countDeviceFound()
 
 		// Find the HHID
 		hhid, err := response.GetHouseholdId()
@@ -456,12 +1600,22 @@ func (app *App) discoverPlayer() Player {
 			continue
 		}
 
+		app.scanLock.Lock()
+		app.scanStats.Matched = app.scanStats.Matched + 1
+		app.scanLock.Unlock()
+
+		// Already have a player?  Just counting the rest.
+		if player != nil {
+			continue
+		}
+
 		// Hit /info to get the player data,
 		infoUrl, err := response.GetInfoUrl()
 		if err != nil {
 			log.Errorf("app: GetInfoUrl: %s", err.Error())
 			continue
 		}
+		infoUrl = sonos.ConvertToApiVersion(infoUrl, apiVersion)
 
 		body, err := app.doRESTWithApiKey(infoUrl, http.MethodGet, nil)
 		if err != nil {
@@ -469,24 +1623,19 @@ func (app *App) discoverPlayer() Player {
 			continue
 		}
 
-		// Parse it and return our happy player so the caller can hit /groups
+		// Parse it and hang on to our happy player so the caller can hit /groups
 		var info sonos.PlayerInfoResponse
 		if json.Unmarshal(body, &info) != nil {
 			log.Errorf("Unable to parse response from /info")
 			continue
 		}
 
-		// We have a player, stop discovery and get out of here.
 		player = NewInternalPlayerFromInfoResponse(info)
-		cancel()
-		break
-	}
-
-	// Shut down the context
-	<-ctx.Done()
 
-	// Return what we found, which could be nil.
-	return player
+		app.scanLock.Lock()
+		app.lastGoodScan = time.Now()
+		app.scanLock.Unlock()
+	}
 }
 
 //
@@ -502,13 +1651,48 @@ func (app *App) getGroupsRest(p Player) (sonos.GroupsResponse, error) {
 	}
 
 	var groups sonos.GroupsResponse
-	if json.Unmarshal(raw, &groups) != nil {
+	if err = json.Unmarshal(raw, &groups); err != nil {
 		return sonos.GroupsResponse{}, err
 	}
+	app.recordGroupsRaw(raw)
 
 	return groups, nil
 }
 
+// recordGroupsRaw hangs on to the last groups response for debugging
+func (app *App) recordGroupsRaw(raw []byte) {
+	if !app.config.Debug {
+		return
+	}
+
+	app.groupsLock.Lock()
+	app.lastGroupsRaw = raw
+	app.groupsLock.Unlock()
+}
+
+// How many times we ask a player we just found for /groups, and how long we wait before the first retry.
+// The wait doubles each time.  Players that just booted tend to fail REST for a second or two, and
+// this beats throwing them away and scanning again.
+const groupsFetchAttempts = 3
+
+var groupsFetchBackoff = 500 * time.Millisecond
+
+// getGroupsRestWithRetry is getGroupsRest with a few retries against the same player
+func (app *App) getGroupsRestWithRetry(p Player) (sonos.GroupsResponse, error) {
+	backoff := groupsFetchBackoff
+
+	for attempt := 1; ; attempt++ {
+		groups, err := app.getGroupsRest(p)
+		if err == nil || attempt == groupsFetchAttempts {
+			return groups, err
+		}
+
+		log.Warnf("app: unable to get groups from %s (attempt %d of %d): %s", p.GetId(), attempt, groupsFetchAttempts, err.Error())
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
 func (a *App) addApiKey(header *http.Header) {
 	header.Add("X-Sonos-Api-Key", a.config.Sonos.ApiKey)
 }
@@ -519,10 +1703,7 @@ func (a *App) addApiKey(header *http.Header) {
 // I could split it out into another class and pass in the key at init time, I suppose.
 //
 func (a *App) doRESTWithApiKey(fullUrl string, method string, body []byte) ([]byte, error) {
-	// FIXME: Can we just fix the CN, or are there really self signed?
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	client := &http.Client{Transport: customTransport}
+	client := newPlayerHTTPClient()
 
 	log.Debugf("REST: %s URL=%s", method, fullUrl)
 
@@ -553,6 +1734,48 @@ func (a *App) doRESTWithApiKey(fullUrl string, method string, body []byte) ([]by
 	return data, nil
 }
 
+// playerProxy picks the proxy for REST and websocket connections to players.  Both use the environment
+// (HTTP_PROXY and friends) by default, and main sets it to nil if the config says to go direct.
+var playerProxy func(*http.Request) (*url.URL, error) = http.ProxyFromEnvironment
+
+// playerTLSConfig is used for REST and websocket connections to players.  By default we don't check the
+// player certs at all, and main replaces it if the config asks for real verification.
+var playerTLSConfig *tls.Config = &tls.Config{InsecureSkipVerify: true}
+
+// newPlayerTLSConfig returns the TLS config for talking to players.  With verify set the player certs
+// are checked against the CAs in caCertFile, or the system CAs if that is empty.
+func newPlayerTLSConfig(verify bool, caCertFile string) (*tls.Config, error) {
+	if !verify {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(caCertFile) == 0 {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caCertFile)
+	}
+
+	return tlsConfig, nil
+}
+
+// newPlayerHTTPClient returns a client that can talk to the players despite their certs
+func newPlayerHTTPClient() *http.Client {
+	// FIXME: Can we just fix the CN, or are there really self signed?
+	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport.TLSClientConfig = playerTLSConfig
+	customTransport.Proxy = playerProxy
+	return &http.Client{Transport: customTransport}
+}
+
 func (a *App) playerDoGET(p Player, path string) ([]byte, error) {
 	return a.doRESTWithApiKey(p.CreateFullRESTUrl(path), http.MethodGet, nil)
 }
@@ -564,6 +1787,20 @@ func (a *App) playerDoPOST(p Player, path string, body []byte) ([]byte, error) {
 //
 // Data munging
 //
+// publishPlayers publishes the players, which includes whether their websockets are up, to {base}/players
+func (app *App) publishPlayers(groups map[string]Group) {
+	if app.mqttClient == nil {
+		return
+	}
+
+	bytes, err := getPlayersJSONFromGroupMap(groups)
+	if err != nil {
+		log.Errorf("app: unable to marshal players: %s", err.Error())
+		return
+	}
+	app.PublishEventToTopic(fmt.Sprintf("%s/%s", app.config.MQTT.Topic, "players"), bytes)
+}
+
 func getPlayersJSONFromGroupMap(groups map[string]Group) ([]byte, error) {
 	// Convert to an array since the map is useless to the end users.  Ew.
 	var playerArray []Player = make([]Player, 0, 64)
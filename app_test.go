@@ -0,0 +1,1823 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+// FakeSonosPlayer is a single player household served over https and wss.  It answers /info and /groups
+// via REST, and events groups and extendedPlaybackStatus when subscribed to over the websocket.
+type FakeSonosPlayer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	lock  sync.Mutex
+	conns []*websocket.Conn
+
+	// Number of /groups requests to fail before answering
+	groupsFailures int
+
+	// Number of groupVolume GETs we answered
+	groupVolumeGets int
+
+	// Last POST to a player namespace we don't otherwise answer
+	lastPlayerPost     string
+	lastPlayerPostBody string
+}
+
+func newFakeSonosPlayer(t *testing.T) *FakeSonosPlayer {
+	fake := &FakeSonosPlayer{
+		t:     t,
+		conns: make([]*websocket.Conn, 0, 4),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/players/local/info", fake.handleInfo)
+	mux.HandleFunc("/api/v1/households/local/groups", fake.handleGroups)
+	mux.HandleFunc("/api/v1/households/local/groups/P1:1/groupVolume", fake.handleGroupVolume)
+	mux.HandleFunc("/api/v1/households/local/players/P1/playerVolume/setMute", fake.handleSetMute)
+	mux.HandleFunc("/api/v1/households/local/players/", fake.handlePlayerPost)
+	mux.HandleFunc("/api/v1/households/local/favorites", fake.handleFavorites)
+	mux.HandleFunc("/websocket/api", fake.handleWebsocket)
+
+	fake.server = httptest.NewTLSServer(mux)
+
+	return fake
+}
+
+func (fake *FakeSonosPlayer) Close() {
+	fake.lock.Lock()
+	for _, conn := range fake.conns {
+		conn.Close()
+	}
+	fake.lock.Unlock()
+
+	fake.server.Close()
+}
+
+func (fake *FakeSonosPlayer) InfoUrl() string {
+	return fake.server.URL + "/api/v1/players/local/info"
+}
+
+func (fake *FakeSonosPlayer) WebsocketUrl() string {
+	return strings.Replace(fake.server.URL, "https", "wss", 1) + "/websocket/api"
+}
+
+func (fake *FakeSonosPlayer) groupsResponse() sonos.GroupsResponse {
+	return sonos.GroupsResponse{
+		Groups: []sonos.Group{
+			{Id: "P1:1", Name: "Kitchen", CoordinatorId: "P1", PlayerIds: []string{"P1"}},
+		},
+		Players: []sonos.Player{
+			{Id: "P1", Name: "Kitchen", WebsocketUrl: fake.WebsocketUrl()},
+		},
+	}
+}
+
+func (fake *FakeSonosPlayer) checkApiKey(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("X-Sonos-Api-Key") != "KEY" {
+		fake.t.Errorf("missing api key on %s", r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (fake *FakeSonosPlayer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	info := sonos.PlayerInfoResponse{
+		HouseholdId:  "HHID",
+		GroupId:      "P1:1",
+		PlayerId:     "P1",
+		WebsocketUrl: fake.WebsocketUrl(),
+		RestUrl:      fake.server.URL + "/api",
+	}
+	info.Device.Name = "Kitchen"
+
+	body, _ := json.Marshal(info)
+	w.Write(body)
+}
+
+func (fake *FakeSonosPlayer) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	fake.lock.Lock()
+	fail := fake.groupsFailures > 0
+	if fail {
+		fake.groupsFailures = fake.groupsFailures - 1
+	}
+	fake.lock.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := json.Marshal(fake.groupsResponse())
+	w.Write(body)
+}
+
+func (fake *FakeSonosPlayer) handleGroupVolume(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	fake.lock.Lock()
+	fake.groupVolumeGets = fake.groupVolumeGets + 1
+	fake.lock.Unlock()
+
+	w.Write([]byte(`{"volume": 42, "muted": false, "fixed": false}`))
+}
+
+func (fake *FakeSonosPlayer) handleFavorites(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	w.Write([]byte(`{"_objectType": "favoritesList", "items": []}`))
+}
+
+func (fake *FakeSonosPlayer) handleSetMute(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	w.Write([]byte(`{}`))
+}
+
+func (fake *FakeSonosPlayer) handlePlayerPost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	fake.lock.Lock()
+	fake.lastPlayerPost = strings.TrimPrefix(r.URL.Path, "/api/v1/households/local/players/")
+	fake.lastPlayerPostBody = string(body)
+	fake.lock.Unlock()
+
+	w.Write([]byte(`{}`))
+}
+
+func (fake *FakeSonosPlayer) lastPost() (string, string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.lastPlayerPost, fake.lastPlayerPostBody
+}
+
+func (fake *FakeSonosPlayer) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !fake.checkApiKey(w, r) {
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fake.t.Errorf("upgrade failed: %s", err.Error())
+		return
+	}
+
+	fake.lock.Lock()
+	fake.conns = append(fake.conns, conn)
+	fake.lock.Unlock()
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		request := sonos.WebsocketRequest{}
+		if err := request.FromRawBytes(raw); err != nil {
+			fake.t.Errorf("unable to parse request: %s", err.Error())
+			continue
+		}
+
+		// Respond to the command, then send an event for the namespaces we know about
+		fake.send(conn, sonos.ResponseHeaders{
+			CommonHeaders: sonos.CommonHeaders{
+				Namespace: request.Headers.Namespace,
+				Command:   request.Headers.Command,
+				CmdId:     request.Headers.CmdId,
+			},
+			Response: request.Headers.Command,
+			Success:  true,
+			Type:     "none",
+		}, nil)
+
+		if request.Headers.Command != "subscribe" {
+			continue
+		}
+
+		switch request.Headers.Namespace {
+		case "groups":
+			body, _ := json.Marshal(fake.groupsResponse())
+			fake.send(conn, sonos.ResponseHeaders{
+				CommonHeaders: sonos.CommonHeaders{
+					Namespace:   "groups",
+					HouseholdId: "HHID",
+				},
+				Type: "groups",
+			}, body)
+
+		case "playbackExtended":
+			status := sonos.ExtendedPlaybackStatus{}
+			status.PlaybackState.PlaybackState = "PLAYBACK_STATE_PLAYING"
+			status.Metadata.CurrentItem.Track.Name = "Track"
+			status.Metadata.CurrentItem.Track.Artist.Name = "Artist"
+			body, _ := json.Marshal(status)
+			fake.send(conn, sonos.ResponseHeaders{
+				CommonHeaders: sonos.CommonHeaders{
+					Namespace:   "playbackExtended",
+					HouseholdId: "HHID",
+					GroupId:     "P1:1",
+					PlayerId:    "P1",
+				},
+				Type: "extendedPlaybackStatus",
+			}, body)
+		}
+	}
+}
+
+func (fake *FakeSonosPlayer) send(conn *websocket.Conn, headers sonos.ResponseHeaders, body []byte) {
+	response := sonos.WebsocketResponse{
+		Headers:  headers,
+		BodyJSON: body,
+	}
+
+	raw, err := response.ToRawBytes()
+	if err != nil {
+		fake.t.Errorf("unable to convert response: %s", err.Error())
+		return
+	}
+
+	conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+//
+// Discovery mock
+//
+
+type MockDiscoveryData struct {
+	hhid    string
+	infoUrl string
+}
+
+func (d *MockDiscoveryData) GetHouseholdId() (string, error) {
+	return d.hhid, nil
+}
+
+func (d *MockDiscoveryData) GetInfoUrl() (string, error) {
+	return d.infoUrl, nil
+}
+
+//
+// MQTT mock.  Publish records what was published, and Subscribe/Unsubscribe track the subscriptions.
+//
+
+type MockMQTTClient struct {
+	lock       sync.Mutex
+	published  map[string][]byte
+	retained   map[string]bool
+	subscribed map[string]bool
+}
+
+func newMockMQTTClient() *MockMQTTClient {
+	return &MockMQTTClient{
+		published:  map[string][]byte{},
+		retained:   map[string]bool{},
+		subscribed: map[string]bool{},
+	}
+}
+
+func (m *MockMQTTClient) IsConnected() bool      { return true }
+func (m *MockMQTTClient) IsConnectionOpen() bool { return true }
+func (m *MockMQTTClient) Connect() mqtt.Token    { return &mqtt.DummyToken{} }
+func (m *MockMQTTClient) Disconnect(uint)        {}
+
+func (m *MockMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var body []byte
+
+	switch p := payload.(type) {
+	case []byte:
+		body = p
+	case string:
+		body = []byte(p)
+	}
+
+	m.lock.Lock()
+	m.published[topic] = body
+	m.retained[topic] = retained
+	m.lock.Unlock()
+
+	return &mqtt.DummyToken{}
+}
+
+func (m *MockMQTTClient) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	m.lock.Lock()
+	m.subscribed[topic] = true
+	m.lock.Unlock()
+
+	return &mqtt.DummyToken{}
+}
+
+func (m *MockMQTTClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &mqtt.DummyToken{}
+}
+
+func (m *MockMQTTClient) AddRoute(string, mqtt.MessageHandler)    {}
+func (m *MockMQTTClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+func (m *MockMQTTClient) Unsubscribe(topics ...string) mqtt.Token {
+	m.lock.Lock()
+	for _, topic := range topics {
+		delete(m.subscribed, topic)
+	}
+	m.lock.Unlock()
+
+	return &mqtt.DummyToken{}
+}
+
+// WaitForTopic polls until something has been published to topic, and returns it
+func (m *MockMQTTClient) WaitForTopic(t *testing.T, topic string) []byte {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		m.lock.Lock()
+		body, ok := m.published[topic]
+		m.lock.Unlock()
+
+		if ok {
+			return body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("timed out waiting for %s", topic)
+	return nil
+}
+
+//
+// Tests
+//
+
+func TestAppEndToEnd(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	// Hand out the fake player exactly once.  Later scans (after the websocket goes away at the
+	// end of the test) find nothing.
+	var scanLock sync.Mutex
+	scanned := false
+
+	scanForPlayersHook = func(ctx context.Context, responseChannel chan sonos.DiscoveryData) {
+		scanLock.Lock()
+		defer scanLock.Unlock()
+
+		if !scanned {
+			scanned = true
+			responseChannel <- &MockDiscoveryData{hhid: "HHID", infoUrl: fake.InfoUrl()}
+		}
+	}
+	defer func() { scanForPlayersHook = sonos.ScanForPlayers }()
+
+	websocketInitHook = NewClientWebSocket
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	config.Sonos.ScanTime = 1
+	config.Sonos.Simplify = true
+	config.Sonos.FanOut = true
+	config.Sonos.Subscriptions.Group = []string{"playbackExtended"}
+	config.Sonos.Fetch = []string{"groupVolume", "favorites"}
+	config.MQTT.Topic = "sonos"
+
+	client := newMockMQTTClient()
+	app := NewApp(config, client)
+	go app.run()
+
+	// Groups and players are published when the groups event comes in
+	client.WaitForTopic(t, "sonos/groupsSimple")
+
+	if players := client.WaitForTopic(t, "sonos/players"); !strings.Contains(string(players), "\"P1\"") {
+		t.Errorf("players missing P1: %s", string(players))
+	}
+
+	// Group volume is fetched via REST once the websockets are up
+	if volume := client.WaitForTopic(t, "sonos/group/P1/groupVolumeSimple"); !strings.Contains(string(volume), "42") {
+		t.Errorf("bogus group volume: %s", string(volume))
+	}
+
+	// Household namespaces in the fetch list are published under the type Sonos gives them
+	client.WaitForTopic(t, "sonos/favoritesList")
+
+	// Playback status goes to the group and is fanned out to the player
+	client.WaitForTopic(t, "sonos/group/P1/extendedPlaybackStatusSimple")
+	body := client.WaitForTopic(t, "sonos/player/P1/extendedPlaybackStatusSimple")
+
+	status := SimpleExtendedPlaybackStatus{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatalf("unable to parse playback status: %s", err.Error())
+	}
+
+	if status.PlaybackState != "PLAYBACK_STATE_PLAYING" || status.Track != "Track" || status.Artist != "Artist" {
+		t.Errorf("bogus playback status: %v", status)
+	}
+
+	// The player state picks up the track from the group
+	if state := client.WaitForTopic(t, "sonos/player/P1/state"); !strings.Contains(string(state), "\"track\":\"Track\"") {
+		t.Errorf("bogus player state: %s", string(state))
+	}
+
+	// Player commands can be sent to the whole group
+	results, err := app.GroupCommand("P1", "playerVolume", "setMute", []byte(`{"muted":true}`))
+	if err != nil || string(results) != `{"P1":{"response":{}}}` {
+		t.Errorf("bogus group command results: %s, %v", string(results), err)
+	}
+
+	if _, err := app.GroupCommand("P1", "groupVolume", "setMute", []byte(`{"muted":true}`)); err == nil || err.Error() != "400" {
+		t.Errorf("group namespace was not rejected: %v", err)
+	}
+
+	// Namespaces can be fetched from every player at once, and failures are per player
+	if results, err := app.PlayersNamespace("groupVolume"); err != nil || !strings.Contains(string(results), `"P1":{"response":{"volume":42`) {
+		t.Errorf("bogus players namespace results: %s, %v", string(results), err)
+	}
+
+	if results, err := app.PlayersNamespace("playerVolume"); err != nil || !strings.Contains(string(results), `"P1":{"error":`) {
+		t.Errorf("players namespace failure missing: %s, %v", string(results), err)
+	}
+
+	// Raw websocket requests come back as raw responses
+	raw, err := app.RawRequestOverWebsocket("P1", []byte(`{"namespace":"groupVolume","command":"getVolume","body":{}}`))
+	if err != nil || !strings.Contains(string(raw), "\"response\":\"getVolume\"") {
+		t.Errorf("bogus raw response: %s, %v", string(raw), err)
+	}
+
+	if _, err := app.RawRequestOverWebsocket("P1", []byte(`{"command":"getVolume"}`)); err == nil || err.Error() != "400" {
+		t.Errorf("request without a namespace was not rejected: %v", err)
+	}
+}
+
+func TestGroupsFetchRetry(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	groupsFetchBackoff = time.Millisecond
+	defer func() { groupsFetchBackoff = 500 * time.Millisecond }()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	app := NewApp(config, nil)
+
+	player := NewInternalPlayerFromSonosPlayer(fake.groupsResponse().Players[0], "HHID", "P1:1")
+
+	// Two failures are retried
+	fake.groupsFailures = 2
+	if response, err := app.getGroupsRestWithRetry(player); err != nil || len(response.Groups) != 1 {
+		t.Errorf("retry did not get the groups: %v", err)
+	}
+
+	// Three are not
+	fake.groupsFailures = 3
+	if _, err := app.getGroupsRestWithRetry(player); err == nil {
+		t.Errorf("no error after running out of attempts")
+	}
+}
+
+func TestPlayerTLSVerification(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	defer func() { playerTLSConfig = &tls.Config{InsecureSkipVerify: true} }()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	app := NewApp(config, nil)
+	player := NewInternalPlayerFromSonosPlayer(fake.groupsResponse().Players[0], "HHID", "P1:1")
+
+	// The fake uses a cert nothing trusts, so verification fails with the real reason
+	playerTLSConfig, _ = newPlayerTLSConfig(true, "")
+	if _, err := app.getGroupsRest(player); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("untrusted cert was accepted: %v", err)
+	}
+
+	// Pinning the CA fixes it
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fake.server.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemBytes, 0600); err != nil {
+		t.Fatalf("unable to write CA file: %s", err.Error())
+	}
+
+	var err error
+	if playerTLSConfig, err = newPlayerTLSConfig(true, caFile); err != nil {
+		t.Fatalf("unable to load CA file: %s", err.Error())
+	}
+
+	if _, err := app.getGroupsRest(player); err != nil {
+		t.Errorf("pinned cert was rejected: %s", err.Error())
+	}
+}
+
+func TestRESTCache(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	config.Sonos.RestCacheTTL = 60000
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", fake.groupsResponse(), 0)
+
+	gets := func() int {
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		return fake.groupVolumeGets
+	}
+
+	for i := 0; i < 3; i++ {
+		if body, err := app.GetDataREST("P1", "groupVolume", ""); err != nil || !strings.Contains(string(body), "42") {
+			t.Errorf("bogus group volume: %s, %v", string(body), err)
+		}
+	}
+	if gets() != 1 {
+		t.Errorf("cache missed: %d GETs", gets())
+	}
+
+	// An event for the namespace means the cache is out of date
+	app.invalidateREST("groupVolume")
+	app.GetDataREST("P1", "groupVolume", "")
+	if gets() != 2 {
+		t.Errorf("invalidated cache was used: %d GETs", gets())
+	}
+}
+
+func TestQoSForTopic(t *testing.T) {
+	config := Config{}
+	config.MQTT.DefaultQoS = 1
+	config.MQTT.Retain = true
+	config.MQTT.QoS = []TopicQoS{
+		{Pattern: "sonos/player/*/position", QoS: 0},
+		{Pattern: "sonos/player/*", QoS: 2},
+	}
+	app := NewApp(config, nil)
+
+	if qos := app.qosForTopic("sonos/player/P1/position"); qos != 0 {
+		t.Errorf("wrong QoS for position: %d instead of 0", qos)
+	}
+
+	if qos := app.qosForTopic("sonos/player/P1/playbackState"); qos != 1 {
+		t.Errorf("wrong QoS for playbackState: %d instead of 1", qos)
+	}
+
+	if qos := app.qosForTopic("sonos/player/P1"); qos != 2 {
+		t.Errorf("wrong QoS for player: %d instead of 2", qos)
+	}
+}
+
+func TestPublishOptionsForType(t *testing.T) {
+	retain := false
+
+	config := Config{}
+	config.MQTT.DefaultQoS = 1
+	config.MQTT.Retain = true
+	config.MQTT.QoS = []TopicQoS{
+		{Type: "extendedPlaybackStatus*", QoS: 0, Retain: &retain},
+		{Pattern: "sonos/group/*/*", Type: "groupVolume", QoS: 2},
+	}
+	app := NewApp(config, nil)
+
+	if qos, retained := app.publishOptionsForTopic("sonos/group/P1/extendedPlaybackStatusSimple"); qos != 0 || retained {
+		t.Errorf("wrong options for extendedPlaybackStatus: %d, %t", qos, retained)
+	}
+
+	if qos, retained := app.publishOptionsForTopic("sonos/group/P1/groupVolume"); qos != 2 || !retained {
+		t.Errorf("wrong options for group groupVolume: %d, %t", qos, retained)
+	}
+
+	// Type matches, but the pattern does not
+	if qos, retained := app.publishOptionsForTopic("sonos/player/P1/groupVolume"); qos != 1 || !retained {
+		t.Errorf("wrong options for player groupVolume: %d, %t", qos, retained)
+	}
+}
+
+func TestCheckEventNamespace(t *testing.T) {
+	app := NewApp(Config{}, nil)
+
+	app.checkEventNamespace("playbackExtended", "extendedPlaybackStatus")
+	app.checkEventNamespace("playbackExtended", "extendedPlaybackStatus")
+	app.checkEventNamespace("playback", "extendedPlaybackStatus")
+
+	if namespaces := app.eventNamespaces["extendedPlaybackStatus"]; len(namespaces) != 2 {
+		t.Errorf("wrong number of namespaces: %d instead of 2", len(namespaces))
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	config := Config{}
+	config.Sonos.MaxFailures = 2
+	app := NewApp(config, nil)
+
+	app.playerFailed("P3", fmt.Errorf("closed"))
+	if app.quarantined["P3"] {
+		t.Errorf("quarantined after one failure")
+	}
+
+	app.playerFailed("P3", fmt.Errorf("closed"))
+	if !app.quarantined["P3"] {
+		t.Errorf("not quarantined after two failures")
+	}
+
+	// Still in the groups, so still quarantined
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	app.releaseQuarantine(groups)
+	if !app.quarantined["P3"] {
+		t.Errorf("released while still in the groups")
+	}
+
+	// Dropped out of the groups
+	groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 2)
+	app.releaseQuarantine(groups)
+	if app.quarantined["P3"] {
+		t.Errorf("still quarantined after dropping out of the groups")
+	}
+}
+
+func TestIsTopicAllowed(t *testing.T) {
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, nil)
+
+	tests := map[string]bool{
+		"sonos":                 true,
+		"sonos/#":               true,
+		"sonos/player/P1/+":     true,
+		"sonosfoo/player":       false,
+		"#":                     false,
+		"+/player/P1":           false,
+		"homeassistant/light/#": false,
+	}
+
+	for topic, expected := range tests {
+		if allowed := app.IsTopicAllowed(topic); allowed != expected {
+			t.Errorf("wrong answer for %s: %t instead of %t", topic, allowed, expected)
+		}
+	}
+}
+
+func TestIsTopicPublishable(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	if !app.isTopicPublishable("anything/goes") {
+		t.Errorf("empty allowlist should allow everything")
+	}
+
+	config := Config{}
+	config.MQTT.Allow = []string{"sonos/players", "sonos/player/*/*"}
+	app = NewApp(config, nil)
+
+	if !app.isTopicPublishable("sonos/player/P1/extendedPlaybackStatusSimple") {
+		t.Errorf("player topic should be allowed")
+	}
+
+	if app.isTopicPublishable("sonos/group/P1/extendedPlaybackStatusSimple") {
+		t.Errorf("group topic should not be allowed")
+	}
+}
+
+func TestSubscribeWithoutWebsocket(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	player := NewInternalPlayerFromSonosPlayer(sonos.Player{Id: "P1", WebsocketUrl: "wss://1.2.3.1:1443/websocket/api"}, "HHID", "P1:1")
+
+	if err := app.subscribe(player, []string{}); err != nil {
+		t.Errorf("nothing to subscribe to, but failed anyway: %s", err.Error())
+	}
+
+	err := app.subscribe(player, []string{"playbackExtended", "playerVolume"})
+	if err == nil || !strings.HasPrefix(err.Error(), "playbackExtended: ") {
+		t.Errorf("subscribe without a websocket did not fail properly: %v", err)
+	}
+}
+
+func TestPausePublishing(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+
+	app.PublishEventToTopic("sonos/players", []byte("before"))
+
+	if _, err := app.SetPublishing("pause"); err != nil {
+		t.Fatalf("pause failed: %s", err.Error())
+	}
+
+	app.PublishEventToTopic("sonos/players", []byte("during"))
+	app.PublishEventToTopic("sonos/groups", []byte("during"))
+
+	client.lock.Lock()
+	players, groupsPublished := client.published["sonos/players"], client.published["sonos/groups"] != nil
+	client.lock.Unlock()
+
+	if string(players) != "before" || groupsPublished {
+		t.Errorf("published while paused")
+	}
+
+	if _, err := app.SetPublishing("resume"); err != nil {
+		t.Fatalf("resume failed: %s", err.Error())
+	}
+
+	if players := client.WaitForTopic(t, "sonos/players"); string(players) != "during" {
+		t.Errorf("cache not published on resume: %s", string(players))
+	}
+	client.WaitForTopic(t, "sonos/groups")
+
+	if _, err := app.SetPublishing("bogus"); err == nil || err.Error() != "404" {
+		t.Errorf("bogus action was not rejected: %v", err)
+	}
+}
+
+func TestNoFanOut(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	msg := SonosResponseWithId{playerId: "P1"}
+	msg.Headers.Namespace = "playbackExtended"
+	msg.Headers.GroupId = "P1:1"
+	msg.Headers.Type = "extendedPlaybackStatus"
+	msg.BodyJSON = []byte("{}")
+
+	app.PublishEventToAllTopics(groups["P1"], &msg)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if _, ok := client.published["sonos/group/P1/extendedPlaybackStatus"]; !ok {
+		t.Errorf("group event not published to the coordinator")
+	}
+
+	for topic := range client.published {
+		if strings.HasPrefix(topic, "sonos/player/") {
+			t.Errorf("group event published to a player without fanout: %s", topic)
+		}
+	}
+}
+
+func TestPlayerState(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	msg := SonosResponseWithId{playerId: "P2"}
+	msg.Headers.Namespace = "playerVolume"
+	msg.Headers.Type = "playerVolume"
+	msg.BodyJSON = []byte(`{"volume":17,"muted":true,"fixed":false}`)
+	app.updatePlayerStates(groups["P1"], &msg)
+
+	msg = SonosResponseWithId{playerId: "P1"}
+	msg.Headers.Namespace = "playback"
+	msg.Headers.GroupId = "P1:1"
+	msg.Headers.Type = "playbackStatus"
+	msg.BodyJSON = []byte(`{"playbackState":"PLAYBACK_STATE_PAUSED"}`)
+	app.updatePlayerStates(groups["P1"], &msg)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if state := string(client.published["sonos/player/P2/state"]); state != `{"volume":17,"muted":true,"playbackState":"PLAYBACK_STATE_PAUSED"}`+"\n" {
+		t.Errorf("bogus state for P2: %s", state)
+	}
+
+	if state := string(client.published["sonos/player/P1/state"]); state != `{"playbackState":"PLAYBACK_STATE_PAUSED"}`+"\n" {
+		t.Errorf("bogus state for P1: %s", state)
+	}
+
+	if _, ok := client.published["sonos/player/P3/state"]; ok {
+		t.Errorf("state published for a player in another group")
+	}
+}
+
+func TestPlayerStateBeforeVolume(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	msg := SonosResponseWithId{playerId: "P3"}
+	msg.Headers.Namespace = "playback"
+	msg.Headers.GroupId = "P3:1"
+	msg.Headers.Type = "playbackStatus"
+	msg.BodyJSON = []byte(`{"playbackState":"PLAYBACK_STATE_PLAYING"}`)
+	app.updatePlayerStates(groups["P3"], &msg)
+
+	// We don't know the volume or whether it is muted yet, so neither is reported
+	if state := string(client.WaitForTopic(t, "sonos/player/P3/state")); state != `{"playbackState":"PLAYBACK_STATE_PLAYING"}`+"\n" {
+		t.Errorf("bogus state before volume: %s", state)
+	}
+
+	// Unmuted is reported once we know it
+	msg = SonosResponseWithId{playerId: "P3"}
+	msg.Headers.Namespace = "playerVolume"
+	msg.Headers.Type = "playerVolume"
+	msg.BodyJSON = []byte(`{"volume":5,"muted":false,"fixed":false}`)
+	app.updatePlayerStates(groups["P3"], &msg)
+
+	if state := string(client.WaitForTopic(t, "sonos/player/P3/state")); state != `{"volume":5,"muted":false,"playbackState":"PLAYBACK_STATE_PLAYING"}`+"\n" {
+		t.Errorf("bogus state after volume: %s", state)
+	}
+}
+
+func TestGroupsSettle(t *testing.T) {
+	config := Config{}
+	config.Sonos.GroupsSettle = 20
+	app := NewApp(config, nil)
+	app.currentState = Listen
+
+	first, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	second, _ := getGroupMap("HHID", newTestGroupsResponse(), 2)
+
+	// A burst of updates only results in one rebuild, with the last groups
+	app.queueGroupsUpdate(first)
+	app.queueGroupsUpdate(second)
+
+	if app.currentState != Listen {
+		t.Fatalf("rebuilt before the groups settled")
+	}
+
+	select {
+	case <-app.groupsSettled():
+		app.applyGroupsUpdate(app.pendingGroups)
+	case <-time.After(time.Second):
+		t.Fatalf("groups never settled")
+	}
+
+	if app.currentState != CreateWebsockets || len(app.pendingGroups) != 1 {
+		t.Errorf("wrong groups update: state=%s, groups=%d", app.currentState, len(app.pendingGroups))
+	}
+
+	// Going back to where we started cancels the update
+	app.currentState = Listen
+	app.queueGroupsUpdate(first)
+	app.cancelGroupsUpdate()
+
+	if app.groupsSettled() != nil || app.pendingGroups != nil {
+		t.Errorf("groups update not cancelled")
+	}
+}
+
+func TestGetGroupsRaw(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	app.recordGroupsRaw([]byte(`{"groups":[]}`))
+
+	if _, err := app.GetGroupsRaw(); err == nil || err.Error() != "404" {
+		t.Errorf("raw groups available without debug: %v", err)
+	}
+
+	app.config.Debug = true
+	if _, err := app.GetGroupsRaw(); err == nil || err.Error() != "404" {
+		t.Errorf("raw groups available before we got any: %v", err)
+	}
+
+	app.recordGroupsRaw([]byte(`{"groups":[]}`))
+	if raw, err := app.GetGroupsRaw(); err != nil || string(raw) != `{"groups":[]}` {
+		t.Errorf("wrong raw groups: %s, %v", string(raw), err)
+	}
+}
+
+func TestEventEnvelope(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.Envelope = true
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	msg := SonosResponseWithId{playerId: "P1"}
+	msg.Headers.Namespace = "groupVolume"
+	msg.Headers.GroupId = "P1:1"
+	msg.Headers.Type = "groupVolume"
+	msg.BodyJSON = []byte(`{"volume":42}`)
+
+	app.PublishEventToAllTopics(groups["P1"], &msg)
+
+	envelope := EventEnvelope{}
+	body := client.WaitForTopic(t, "sonos/group/P1/groupVolume")
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("unable to parse envelope: %s", err.Error())
+	}
+
+	if envelope.Headers.Namespace != "groupVolume" || envelope.Headers.GroupId != "P1:1" || string(envelope.Body) != `{"volume":42}` {
+		t.Errorf("bogus envelope: %s", string(body))
+	}
+}
+
+func TestSkipEmpty(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.SkipEmpty = true
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	for _, body := range []string{"", "  ", "{}", " { } ", `{"volume":42}`} {
+		msg := SonosResponseWithId{playerId: "P1"}
+		msg.Headers.Namespace = "groupVolume"
+		msg.Headers.GroupId = "P1:1"
+		msg.Headers.Type = "groupVolume"
+		msg.BodyJSON = []byte(body)
+		app.PublishEventToAllTopics(groups["P1"], &msg)
+
+		client.lock.Lock()
+		published, ok := client.published["sonos/group/P1/groupVolume"]
+		client.lock.Unlock()
+
+		if body == `{"volume":42}` {
+			if !ok || string(published) != body {
+				t.Errorf("non-empty body was not published: %s", string(published))
+			}
+		} else if ok {
+			t.Errorf("empty body %q was published", body)
+		}
+	}
+}
+
+func TestMsgpackFormat(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.Format = "msgpack"
+	app := NewApp(config, client)
+
+	app.publishFormat()
+	app.PublishEventToTopic("sonos/topology/seq", []byte("7"))
+
+	if format := client.WaitForTopic(t, "sonos/format"); string(format) != "msgpack" {
+		t.Errorf("wrong format: %s", string(format))
+	}
+
+	if seq := client.WaitForTopic(t, "sonos/topology/seq"); !bytes.Equal(seq, []byte{0x07}) {
+		t.Errorf("seq was not converted: %x", seq)
+	}
+}
+
+func TestDuplicateGroupsEvent(t *testing.T) {
+	app := NewApp(Config{}, nil)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	changed := newTestGroupsResponse()
+	changed.Groups[0].PlayerIds = []string{"P1"}
+	changedGroups, _ := getGroupMap("HHID", changed, 0)
+
+	if app.isDuplicateGroupsEvent("P1", groups) {
+		t.Errorf("first event is a duplicate")
+	}
+
+	if !app.isDuplicateGroupsEvent("P3", groups) {
+		t.Errorf("same event from the other source is not a duplicate")
+	}
+
+	if app.isDuplicateGroupsEvent("P1", groups) {
+		t.Errorf("same event from the same source is a duplicate")
+	}
+
+	if app.isDuplicateGroupsEvent("P3", changedGroups) {
+		t.Errorf("new groups from the other source are a duplicate")
+	}
+}
+
+func TestErrorSettle(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	config := Config{}
+	config.Sonos.ErrorSettle = 60000
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+	app.currentState = Listen
+
+	ws := newMockWebsocketClient()
+	ws.respondToMessages = false
+
+	// Reconnects need something to reconnect, so P2 was up and went down
+	app.groups["P1"].Players["P2"].InitWebsocketConnection(http.Header{}, app)
+	ws.Close()
+	ws = newMockWebsocketClient()
+	ws.respondToMessages = false
+
+	// One player failing gets that player reconnected
+	app.queueError("P2", fmt.Errorf("blip"))
+	if app.currentState != Listen || app.errorsSettled() == nil {
+		t.Errorf("first error did not wait")
+	}
+
+	app.handleSettledErrors()
+	if app.currentState != Listen || !app.groups["P1"].Players["P2"].HasWebsocket() {
+		t.Errorf("single error was not handled with a reconnect")
+	}
+
+	// More than one rebuilds everything
+	app.queueError("P1", fmt.Errorf("blip"))
+	app.queueError("P3", fmt.Errorf("blip"))
+	app.handleSettledErrors()
+	if app.currentState != Idle || app.errorsSettled() != nil {
+		t.Errorf("multiple errors did not rebuild")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+	defer func(base time.Duration) { reconnectBackoffBase = base }(reconnectBackoffBase)
+	reconnectBackoffBase = time.Millisecond
+
+	config := Config{}
+	config.Sonos.ErrorSettle = 60000
+	config.Sonos.ReconnectAttempts = 3
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+	app.currentState = Listen
+
+	failDials := func() {
+		websocketInitHook = func(url string, userData string, headers http.Header, callbacks WebsocketCallbacks) WebsocketClient {
+			return nil
+		}
+	}
+
+	retry := func() {
+		select {
+		case id := <-app.reconnectChannel:
+			app.handleReconnect(id)
+		case <-time.After(time.Second):
+			t.Fatalf("reconnect was not retried")
+		}
+	}
+
+	// Reconnects need something to reconnect, so P2 was up and went down
+	ws := newMockWebsocketClient()
+	ws.respondToMessages = false
+	app.groups["P1"].Players["P2"].InitWebsocketConnection(http.Header{}, app)
+	ws.Close()
+
+	// Two failures get retried, and the third try works
+	failDials()
+	app.queueError("P2", fmt.Errorf("blip"))
+	app.handleSettledErrors()
+	retry()
+	if app.currentState != Listen || app.reconnectAttempts["P2"] != 2 {
+		t.Errorf("failed reconnects were not retried: %s, %d", app.currentState, app.reconnectAttempts["P2"])
+	}
+
+	ws = newMockWebsocketClient()
+	ws.respondToMessages = false
+	retry()
+	if app.currentState != Listen || !app.groups["P1"].Players["P2"].HasWebsocket() || len(app.reconnectAttempts) != 0 {
+		t.Errorf("player was not reconnected")
+	}
+
+	// Running out of attempts rebuilds everything
+	ws.Close()
+	failDials()
+	app.queueError("P2", fmt.Errorf("blip"))
+	app.handleSettledErrors()
+	retry()
+	retry()
+	if app.currentState != Idle || len(app.reconnectTimers) != 0 {
+		t.Errorf("did not give up after %d attempts", config.Sonos.ReconnectAttempts)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.playerConnected(groups["P1"], "P2")
+	app.playerFailed("P2", fmt.Errorf("closed"))
+	app.playerConnected(groups["P1"], "P2")
+	app.playerConnected(groups["P1"], "P1")
+
+	body, err := app.GetStats()
+	stats := Stats{}
+	if err != nil || json.Unmarshal(body, &stats) != nil {
+		t.Fatalf("bogus stats: %s, %v", string(body), err)
+	}
+
+	if stats.Players["P2"].Reconnects != 1 || stats.Players["P2"].LastError != "closed" || stats.Players["P2"].LastErrorTime == nil {
+		t.Errorf("bogus history for P2: %s", string(body))
+	}
+
+	if stats.Players["P1"].Reconnects != 0 || stats.Players["P1"].LastError != "" {
+		t.Errorf("bogus history for P1: %s", string(body))
+	}
+}
+
+func TestHealth(t *testing.T) {
+	app := NewApp(Config{}, newMockMQTTClient())
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	body, healthy, err := app.GetHealth()
+	if err != nil || healthy {
+		t.Errorf("healthy before listening: %s, %v", string(body), err)
+	}
+
+	app.reportedState = Listen
+	body, healthy, err = app.GetHealth()
+	health := Health{}
+	if err != nil || !healthy || json.Unmarshal(body, &health) != nil {
+		t.Fatalf("not healthy while listening: %s, %v", string(body), err)
+	}
+
+	if health.State != "Listen" || health.Groups != 2 || health.Players != 3 || health.ConnectedPlayers != 0 || !health.MQTTConnected {
+		t.Errorf("bogus health: %s", string(body))
+	}
+
+	// No broker, no health
+	app.mqttClient = nil
+	if _, healthy, _ = app.GetHealth(); healthy {
+		t.Errorf("healthy without MQTT")
+	}
+}
+
+func TestPublishOffline(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	for id, role := range map[string]string{"P1": "coordinator", "P2": "member"} {
+		app.publishOffline(id, fmt.Errorf("websocket closed"))
+
+		availability := PlayerAvailability{}
+		body := client.WaitForTopic(t, fmt.Sprintf("sonos/player/%s/availability", id))
+		if err := json.Unmarshal(body, &availability); err != nil {
+			t.Fatalf("unable to parse availability: %s", err.Error())
+		}
+
+		if availability.Online || availability.GroupId != "P1:1" || availability.CoordinatorId != "P1" || availability.Role != role {
+			t.Errorf("bogus availability for %s: %s", id, string(body))
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.CacheSize = 2
+	app := NewApp(config, client)
+
+	app.PublishEventToTopic("sonos/a", []byte("1"))
+	app.PublishEventToTopic("sonos/b", []byte("2"))
+	app.PublishEventToTopic("sonos/a", []byte("3"))
+	app.PublishEventToTopic("sonos/c", []byte("4"))
+
+	// b was the least recently published, so it goes
+	app.publishLock.Lock()
+	_, hasA := app.mqttCache["sonos/a"]
+	_, hasB := app.mqttCache["sonos/b"]
+	size := len(app.mqttCache)
+	app.publishLock.Unlock()
+
+	if !hasA || hasB || size != 2 {
+		t.Errorf("wrong topics evicted: a=%t, b=%t, size=%d", hasA, hasB, size)
+	}
+
+	client.lock.Lock()
+	cleared := client.published["sonos/b"]
+	client.lock.Unlock()
+
+	if len(cleared) != 0 {
+		t.Errorf("evicted topic was not cleared: %s", string(cleared))
+	}
+}
+
+func TestPlaybackTransition(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.Sonos.Transitions = true
+	app := NewApp(config, client)
+
+	groups, _ := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	topic := "sonos/group/P1/playbackTransition"
+
+	playback := func(state string) []byte {
+		msg := SonosResponseWithId{playerId: "P1"}
+		msg.Headers.Namespace = "playback"
+		msg.Headers.GroupId = "P1:1"
+		msg.Headers.Type = "playbackStatus"
+		msg.BodyJSON = []byte(fmt.Sprintf(`{"playbackState":"%s"}`, state))
+		app.checkPlaybackTransition(groups["P1"], &msg)
+
+		client.lock.Lock()
+		defer client.lock.Unlock()
+		body := client.published[topic]
+		delete(client.published, topic)
+		return body
+	}
+
+	if body := playback("PLAYBACK_STATE_PAUSED"); body != nil {
+		t.Errorf("first state was published: %s", string(body))
+	}
+
+	if body := playback("PLAYBACK_STATE_PLAYING"); string(body) != `{"groupId":"P1:1","from":"PLAYBACK_STATE_PAUSED","to":"PLAYBACK_STATE_PLAYING"}` {
+		t.Errorf("bogus transition: %s", string(body))
+	}
+
+	// Buffering is playing, so nothing changed
+	if body := playback("PLAYBACK_STATE_BUFFERING"); body != nil {
+		t.Errorf("non-transition was published: %s", string(body))
+	}
+}
+
+func TestPublishStale(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.Stale = true
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.clearStale()
+	if body := client.WaitForTopic(t, "sonos/stale"); len(body) != 0 {
+		t.Errorf("stale was not cleared: %s", string(body))
+	}
+
+	app.Shutdown(0)
+	if body := client.WaitForTopic(t, "sonos/stale"); string(body) != `{"players":["P1","P2","P3"],"groups":["P1","P3"]}` {
+		t.Errorf("bogus stale topology: %s", string(body))
+	}
+}
+
+func TestGroupsSnapshot(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.publishGroupsSnapshot()
+
+	// Sorted, with the coordinator first, so dedup works and the coordinator is easy to find
+	expected := `[{"id":"P1","name":"Kitchen + Den","playerCount":2,"players":[{"id":"P1","name":"Kitchen"},{"id":"P2","name":"Den"}]},` +
+		`{"id":"P3","name":"Office","playerCount":1,"players":[{"id":"P3","name":"Office"}]}]`
+	if body := client.WaitForTopic(t, "sonos/topology/groups"); string(body) != expected {
+		t.Errorf("bogus groups snapshot: %s", string(body))
+	}
+}
+
+func TestRemoveStaleTopics(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.DefaultQoS = 1
+	config.MQTT.Retain = true
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	// Publish the way events do, so this breaks if the two ever disagree on paths
+	msg := SonosResponseWithId{playerId: "P2"}
+	msg.Headers.Namespace = "playerVolume"
+	msg.Headers.Type = "playerVolume"
+	msg.BodyJSON = []byte(`{"volume":10}`)
+	app.PublishEventToAllTopics(app.groups["P1"], &msg)
+
+	app.PublishEventToTopic("sonos/player/P20/playerVolume", []byte(`{"volume":20}`))
+
+	app.RemoveStaleTopics([]string{"P2"}, []string{})
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if body, ok := client.published["sonos/player/P2/playerVolume"]; !ok || len(body) != 0 || !client.retained["sonos/player/P2/playerVolume"] {
+		t.Errorf("P2 was not cleared with a retained publish: %s", string(body))
+	}
+
+	if body := client.published["sonos/player/P20/playerVolume"]; len(body) == 0 {
+		t.Errorf("P20 was cleared along with P2")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	for _, dedup := range []bool{true, false} {
+		client := newMockMQTTClient()
+
+		config := Config{}
+		config.MQTT.Topic = "sonos"
+		config.MQTT.Retain = true
+		config.MQTT.Dedup = dedup
+		app := NewApp(config, client)
+
+		app.PublishEventToTopic("sonos/a", []byte("1"))
+
+		client.lock.Lock()
+		delete(client.published, "sonos/a")
+		client.lock.Unlock()
+
+		app.PublishEventToTopic("sonos/a", []byte("1"))
+
+		client.lock.Lock()
+		_, republished := client.published["sonos/a"]
+		client.lock.Unlock()
+
+		if republished == dedup {
+			t.Errorf("dedup=%t: republished=%t", dedup, republished)
+		}
+	}
+}
+
+func TestDedupNotRetained(t *testing.T) {
+	client := newMockMQTTClient()
+
+	noRetain := false
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.Retain = true
+	config.MQTT.Dedup = true
+	config.MQTT.QoS = []TopicQoS{{Type: "transient", QoS: 0, Retain: &noRetain}}
+	app := NewApp(config, client)
+
+	// Nobody who subscribes later will get the first one from the broker, so repeats have to go out
+	for _, topic := range []string{"sonos/transient", "sonos/retained"} {
+		app.PublishEventToTopic(topic, []byte("1"))
+
+		client.lock.Lock()
+		delete(client.published, topic)
+		client.lock.Unlock()
+
+		app.PublishEventToTopic(topic, []byte("1"))
+
+		client.lock.Lock()
+		_, republished := client.published[topic]
+		client.lock.Unlock()
+
+		if republished != (topic == "sonos/transient") {
+			t.Errorf("%s: republished=%t", topic, republished)
+		}
+	}
+}
+
+func TestSetHouseholdPublishing(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	if _, err := app.SetHouseholdPublishing("OTHER", "pause"); err == nil || err.Error() != "404" {
+		t.Errorf("unknown household was not a 404: %v", err)
+	}
+
+	if state, err := app.SetHouseholdPublishing("HHID", "pause"); err != nil || string(state) != `{"paused":true}` {
+		t.Errorf("household pause failed: %s, %v", string(state), err)
+	}
+
+	app.SetHouseholdPublishing("HHID", "resume")
+}
+
+func TestFirstGroupsEvent(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+
+	// Pretend we got the groups via REST and just subscribed
+	response := newTestGroupsResponse()
+	app.groups, _ = getGroupMap("HHID", response, 0)
+	app.currentState = Listen
+
+	groupsEvent := func(response sonos.GroupsResponse) {
+		msg := SonosResponseWithId{playerId: "P1"}
+		msg.Headers.Namespace = "groups"
+		msg.Headers.HouseholdId = "HHID"
+		msg.Headers.Type = "groups"
+		msg.BodyJSON, _ = json.Marshal(response)
+		app.handleResponse(msg)
+	}
+
+	// The first event matches what we got via REST, so nothing changes but the players are published
+	groupsEvent(response)
+
+	if app.currentState != Listen || app.pendingGroups != nil {
+		t.Errorf("first groups event caused a rebuild")
+	}
+
+	if players := client.WaitForTopic(t, "sonos/players"); !strings.Contains(string(players), "\"P3\"") {
+		t.Errorf("players missing P3: %s", string(players))
+	}
+
+	// Drop P3 and the players come from the event, not the groups we are still connected to
+	response.Groups = response.Groups[:1]
+	response.Players = response.Players[:2]
+	groupsEvent(response)
+
+	if app.currentState != CreateWebsockets || len(app.pendingGroups) != 1 {
+		t.Errorf("groups change did not cause a rebuild")
+	}
+
+	if players := client.WaitForTopic(t, "sonos/players"); strings.Contains(string(players), "\"P3\"") {
+		t.Errorf("players still contain P3: %s", string(players))
+	}
+}
+
+// Token for a publish the broker did not like
+type failedToken struct {
+	mqtt.DummyToken
+}
+
+func (t *failedToken) Error() error { return fmt.Errorf("not authorized") }
+
+func TestCheckPublish(t *testing.T) {
+	config := Config{}
+	config.MQTT.FailureLogInterval = 60
+	app := NewApp(config, nil)
+
+	app.checkPublish("sonos/players", &mqtt.DummyToken{})
+	app.checkPublish("sonos/players", &failedToken{})
+	app.checkPublish("sonos/groups", &failedToken{})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		app.publishFailureLock.Lock()
+		failures, logged := app.publishFailures, !app.lastPublishFailureLog.IsZero()
+		app.publishFailureLock.Unlock()
+
+		if failures == 2 {
+			if !logged {
+				t.Errorf("failure was not logged")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("failures not counted")
+}
+
+func TestRuntimeSubscriptions(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.SetSubscription("playbackMetadata", true)
+	if namespaces, err := app.SetSubscription("playerVolume", true); err != nil || string(namespaces) != `["playbackMetadata","playerVolume"]` {
+		t.Errorf("wrong subscriptions: %s, %v", string(namespaces), err)
+	}
+
+	// Group namespaces only go to the coordinator, player namespaces go to everyone
+	group := app.groups["P1"]
+	if namespaces := app.runtimeNamespacesFor(group, group.Players["P1"]); len(namespaces) != 2 {
+		t.Errorf("wrong namespaces for the coordinator: %v", namespaces)
+	}
+	if namespaces := app.runtimeNamespacesFor(group, group.Players["P2"]); len(namespaces) != 1 || namespaces[0] != "playerVolume" {
+		t.Errorf("wrong namespaces for a player: %v", namespaces)
+	}
+
+	if namespaces, err := app.SetSubscription("playbackMetadata", false); err != nil || string(namespaces) != `["playerVolume"]` {
+		t.Errorf("wrong subscriptions after unsubscribe: %s, %v", string(namespaces), err)
+	}
+
+	if _, err := app.SetSubscription("playbackMetadata", false); err == nil || err.Error() != "404" {
+		t.Errorf("unsubscribed from something we were not subscribed to: %v", err)
+	}
+}
+
+// slowPlayer takes a while to open its websocket, and fails if told to.  It keeps track of how many
+// are dialing at once so we can check the worker limit.
+type slowPlayer struct {
+	Player
+	delay   time.Duration
+	fail    bool
+	dialing *int32
+	peak    *int32
+}
+
+func (p *slowPlayer) InitWebsocketConnection(headers http.Header, eventHandler PlayerEventHandler) error {
+	now := atomic.AddInt32(p.dialing, 1)
+	for {
+		peak := atomic.LoadInt32(p.peak)
+		if now <= peak || atomic.CompareAndSwapInt32(p.peak, peak, now) {
+			break
+		}
+	}
+
+	time.Sleep(p.delay)
+	atomic.AddInt32(p.dialing, -1)
+
+	if p.fail {
+		return fmt.Errorf("unreachable")
+	}
+	return nil
+}
+
+func TestOpenWebsocketsParallel(t *testing.T) {
+	config := Config{}
+	config.Sonos.OpenWorkers = 4
+	app := NewApp(config, nil)
+
+	var dialing, peak int32
+	players := map[string]Player{}
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("P%d", i)
+		player := NewInternalPlayerFromSonosPlayer(sonos.Player{Id: id, Name: id}, "HHID", id)
+		players[id] = &slowPlayer{Player: player, delay: 50 * time.Millisecond, fail: i%3 == 0, dialing: &dialing, peak: &peak}
+	}
+	app.groups = map[string]Group{"P0": {Id: "P0", Coordinator: players["P0"], Players: players}}
+
+	// 12 players at 50ms each is 600ms one at a time, and 150ms four at a time
+	start := time.Now()
+	openErrors := app.openWebsockets(http.Header{})
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("took %s, which is not parallel", elapsed)
+	}
+
+	if peak > 4 {
+		t.Errorf("%d dialing at once with 4 workers", peak)
+	}
+
+	// Everyone was tried, and only the bad ones failed
+	if len(openErrors) != 12 {
+		t.Fatalf("only %d players tried", len(openErrors))
+	}
+	for i := 0; i < 12; i++ {
+		if err := openErrors[fmt.Sprintf("P%d", i)]; (err != nil) != (i%3 == 0) {
+			t.Errorf("P%d: wrong result: %v", i, err)
+		}
+	}
+}
+
+func TestDrainChannelsUnderLoad(t *testing.T) {
+	config := Config{}
+	config.Sonos.EventBuffer = 64
+	app := NewApp(config, nil)
+
+	// A full buffer's worth goes in without anyone reading
+	for i := 0; i < 64; i++ {
+		app.OnEvent("P1", sonos.WebsocketResponse{})
+	}
+	if len(app.responseChannel) != 64 {
+		t.Fatalf("only %d events buffered", len(app.responseChannel))
+	}
+
+	// A bunch of websockets keep at it while we drain, which is what a regroup looks like.  None of them
+	// can get stuck, and once they stop a drain leaves nothing behind.
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if j%50 == 0 {
+					app.OnError(id, fmt.Errorf("closed"))
+				} else {
+					app.OnEvent(id, sonos.WebsocketResponse{})
+				}
+			}
+		}(fmt.Sprintf("P%d", i))
+	}
+
+	senders := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(senders)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case <-senders:
+			done = true
+		case <-timeout:
+			t.Fatalf("senders are stuck")
+		default:
+			app.drainChannels()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	app.drainChannels()
+	if len(app.responseChannel) != 0 || len(app.errorChannel) != 0 {
+		t.Errorf("left %d events and %d errors", len(app.responseChannel), len(app.errorChannel))
+	}
+}
+
+func TestLastGroupsSourceRebuilds(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	config := Config{}
+	config.Sonos.ErrorSettle = 60000
+	config.Sonos.ReconnectAttempts = 5
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+	app.currentState = Listen
+
+	ws := newMockWebsocketClient()
+	ws.respondToMessages = false
+	app.groups["P3"].Players["P3"].InitWebsocketConnection(http.Header{}, app)
+	app.groupsSources = []string{"P1", "P3"}
+
+	// P3 is still watching the groups, so P1 gets a reconnect
+	app.queueError("P1", fmt.Errorf("blip"))
+	app.handleSettledErrors()
+	if app.currentState != Listen {
+		t.Errorf("rebuilt with another groups source up")
+	}
+	app.cancelErrors()
+
+	// Once P3 is gone too nobody is
+	app.groupsSources = []string{"P1"}
+	app.queueError("P1", fmt.Errorf("blip"))
+	app.handleSettledErrors()
+	if app.currentState != Idle {
+		t.Errorf("did not rebuild after losing the last groups source")
+	}
+}
+
+func TestFetchArtOnlyFromPlayer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("art"))
+	}))
+	defer server.Close()
+
+	app := NewApp(Config{}, nil)
+	player := NewInternalPlayerFromInfoResponse(sonos.PlayerInfoResponse{
+		PlayerId: "P1",
+		GroupId:  "P1:1",
+		RestUrl:  "https://127.0.0.1:1443/api/v1",
+	})
+	app.groups = map[string]Group{"P1:1": {Id: "P1:1", Coordinator: player, Players: map[string]Player{"P1": player}}}
+
+	// Same host as the player, different port, which is how the players serve art
+	data, contentType, err := app.FetchArt("P1", server.URL+"/getaa")
+	if err != nil || string(data) != "art" || contentType != "image/jpeg" {
+		t.Errorf("fetch from player failed: %v", err)
+	}
+
+	for _, artUrl := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		"http://localhost.example.com/a.jpg",
+		"file:///etc/passwd",
+	} {
+		if _, _, err := app.FetchArt("P1", artUrl); err == nil || err.Error() != "400" {
+			t.Errorf("%s: expected 400, got %v", artUrl, err)
+		}
+	}
+
+	if _, _, err := app.FetchArt("P9", server.URL+"/getaa"); err == nil || err.Error() != "404" {
+		t.Errorf("unknown player: expected 404, got %v", err)
+	}
+}
+
+func TestDiscoverPlayerCountsEveryone(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	scanForPlayersHook = func(ctx context.Context, responseChannel chan sonos.DiscoveryData) {
+		responseChannel <- &MockDiscoveryData{hhid: "OTHER", infoUrl: fake.InfoUrl()}
+		responseChannel <- &MockDiscoveryData{hhid: "HHID", infoUrl: "https://127.0.0.1:1/api/v1/players/local/info"}
+		responseChannel <- &MockDiscoveryData{hhid: "HHID", infoUrl: fake.InfoUrl()}
+		responseChannel <- &MockDiscoveryData{hhid: "HHID", infoUrl: fake.InfoUrl()}
+	}
+	defer func() { scanForPlayersHook = sonos.ScanForPlayers }()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	config.Sonos.ScanTime = 1
+	config.Sonos.HouseholdId = "HHID"
+	app := NewApp(config, nil)
+
+	// The first player that answers /info wins, and everyone after it is still counted
+	player := app.discoverPlayer()
+	if player == nil || player.GetId() != "P1" {
+		t.Fatalf("bogus player: %v", player)
+	}
+
+	if app.scanStats.Found != 4 || app.scanStats.Matched != 3 {
+		t.Errorf("bogus scan stats: %+v", app.scanStats)
+	}
+}
+
+func TestSetEQ(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", fake.groupsResponse(), 0)
+
+	// Only what was asked for goes to the player, and anything we don't know about is dropped
+	if _, err := app.SetEQ("P1", []byte(`{"bass":3,"loudness":true,"bogus":1}`)); err != nil {
+		t.Fatalf("set eq failed: %s", err.Error())
+	}
+	if path, body := fake.lastPost(); path != "P1/settings/setPlayerSettings" || body != `{"bass":3,"loudness":true}` {
+		t.Errorf("bogus post: %s %s", path, body)
+	}
+
+	for _, body := range []string{`{"bass":11}`, `{"treble":-11}`, `{"balance":101}`, `not json`} {
+		if _, err := app.SetEQ("P1", []byte(body)); err == nil || err.Error() != "400" {
+			t.Errorf("%s: expected 400, got %v", body, err)
+		}
+	}
+
+	if _, err := app.SetEQ("P9", []byte(`{"bass":3}`)); err == nil || err.Error() != "404" {
+		t.Errorf("unknown player: expected 404, got %v", err)
+	}
+}
+
+func TestSetHomeTheater(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", fake.groupsResponse(), 0)
+
+	if _, err := app.SetHomeTheater("P1", []byte(`{"nightMode":true}`)); err != nil {
+		t.Fatalf("set options failed: %s", err.Error())
+	}
+	if path, body := fake.lastPost(); path != "P1/homeTheater/setOptions" || body != `{"nightMode":true}` {
+		t.Errorf("bogus options post: %s %s", path, body)
+	}
+
+	if _, err := app.SetHomeTheater("P1", []byte(`not json`)); err == nil || err.Error() != "400" {
+		t.Errorf("bad body: expected 400, got %v", err)
+	}
+
+	// Through the API this time, switching to the TV input
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find a port: %s", err.Error())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv, _ := StartWebServer(port, false, app)
+	defer srv.Close()
+
+	apiUrl := fmt.Sprintf("http://127.0.0.1:%d/api/v1/player/P1/hometheater", port)
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		if response, err = http.Post(apiUrl, "application/json", strings.NewReader(`{"tv":true}`)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("post failed: %s", err.Error())
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("bogus status: %d", response.StatusCode)
+	}
+	if path, body := fake.lastPost(); path != "P1/homeTheater/loadHomeTheaterPlayback" || body != `{}` {
+		t.Errorf("bogus tv post: %s %s", path, body)
+	}
+}
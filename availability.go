@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Per-player availability, published to {base}/player/{playerId}/availability.  A player is online once
+// its websocket is open and subscribed, and offline when that fails or the websocket dies.  The group
+// the player was in at the time is included since it is gone by the time the topology is rebuilt, and
+// automations want to know if the player that vanished was running a group.
+//
+
+type PlayerAvailability struct {
+	Online        bool   `json:"online"`
+	GroupId       string `json:"groupId,omitempty"`
+	CoordinatorId string `json:"coordinatorId,omitempty"`
+	Role          string `json:"role,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// publishAvailability publishes the availability of a player in a group.  err is nil when online.
+func (app *App) publishAvailability(group Group, id string, err error) {
+	if app.mqttClient == nil {
+		return
+	}
+
+	availability := PlayerAvailability{
+		Online: err == nil,
+		Role:   "member",
+	}
+
+	if group.Coordinator != nil {
+		availability.GroupId = group.Id
+		availability.CoordinatorId = group.Coordinator.GetId()
+		if availability.CoordinatorId == id {
+			availability.Role = "coordinator"
+		}
+	}
+
+	if err != nil {
+		availability.Error = err.Error()
+	}
+
+	body, jsonErr := json.Marshal(availability)
+	if jsonErr != nil {
+		log.Errorf("app: unable to marshal availability for %s: %s", id, jsonErr.Error())
+		return
+	}
+
+	app.PublishEventToTopic(app.topicFor("player", id, "", "availability"), body)
+}
+
+// publishOffline publishes a player as offline using whatever group it is in right now.  Main goroutine only.
+func (app *App) publishOffline(id string, err error) {
+	group, _ := findGroupForPlayer(app.groups, id)
+	app.publishAvailability(group, id, err)
+}
+
+// StaleTopology is published to {base}/stale when we shut down so dashboards can grey out what we were
+// publishing.  MQTT only gives us one will, and it is used for {base}/bridge/state, so if we vanish
+// without shutting down that is all subscribers get.
+type StaleTopology struct {
+	Players []string `json:"players"`
+	Groups  []string `json:"groups"`
+}
+
+func staleTopic(base string) string {
+	return fmt.Sprintf("%s/stale", base)
+}
+
+// clearStale removes whatever the last run left on the stale topic, since we are back.  Like the
+// format topic this goes straight to the broker so it is always JSON (or empty).
+func (app *App) clearStale() {
+	if !app.config.MQTT.Stale || app.mqttClient == nil {
+		return
+	}
+
+	topic := staleTopic(app.config.MQTT.Topic)
+	app.checkPublish(topic, app.mqttClient.Publish(topic, 1, true, ""))
+}
+
+// publishStale publishes the players and groups we are about to stop updating
+func (app *App) publishStale() {
+	if !app.config.MQTT.Stale || app.mqttClient == nil {
+		return
+	}
+
+	stale := StaleTopology{Players: []string{}, Groups: []string{}}
+
+	app.groupsLock.RLock()
+	for id := range getPlayers(app.groups) {
+		stale.Players = append(stale.Players, id)
+	}
+	for id := range app.groups {
+		stale.Groups = append(stale.Groups, id)
+	}
+	app.groupsLock.RUnlock()
+
+	sort.Strings(stale.Players)
+	sort.Strings(stale.Groups)
+
+	body, err := json.Marshal(stale)
+	if err != nil {
+		return
+	}
+
+	topic := staleTopic(app.config.MQTT.Topic)
+	if token := app.mqttClient.Publish(topic, 1, true, body); !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		log.Errorf("app: unable to publish stale topology")
+	}
+}
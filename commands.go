@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Commands over MQTT.  If commands is set in the config we subscribe to:
+//
+//   {base}/command/player/{playerId}/{namespace}/{command}
+//
+// and POST the payload to the player, same as POST /api/v1/player/{id}/{namespace}/{command} does.  Group
+// namespaces go to the coordinator of the player's group.  What the player said (or why we couldn't ask it)
+// is published to {base}/command/player/{playerId}/result, which is not retained since it only makes sense
+// to whoever sent the command.
+//
+
+type CommandResult struct {
+	Namespace string          `json:"namespace"`
+	Command   string          `json:"command"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+func commandFilter(base string) string {
+	return fmt.Sprintf("%s/command/player/+/+/+", base)
+}
+
+// subscribeCommands subscribes to the command topics.  The session is not clean, so the broker remembers
+// the subscription across reconnects.
+func (app *App) subscribeCommands() {
+	if !app.config.MQTT.Commands || app.mqttClient == nil {
+		return
+	}
+
+	filter := commandFilter(app.config.MQTT.Topic)
+	token := app.mqttClient.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		// Players can take a while to answer, and paho won't deliver anything else until we return
+		go app.handleCommand(msg.Topic(), msg.Payload())
+	})
+
+	if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		log.Errorf("app: unable to subscribe to %s", filter)
+		return
+	}
+	log.Infof("app: listening for commands on %s", filter)
+}
+
+// validCommandTopic checks the topic segments against the same patterns the web server uses for its
+// path variables, so nothing odd ends up in the URL we POST to
+func validCommandTopic(id string, namespace string, command string) bool {
+	return pathVarPatterns["id"].MatchString(id) &&
+		pathVarPatterns["namespace"].MatchString(namespace) &&
+		pathVarPatterns["command"].MatchString(command)
+}
+
+// handleCommand sends a command that showed up on MQTT to the player and publishes the result
+func (app *App) handleCommand(topic string, payload []byte) {
+	prefix := fmt.Sprintf("%s/command/player/", app.config.MQTT.Topic)
+	parts := strings.Split(strings.TrimPrefix(topic, prefix), "/")
+	if !strings.HasPrefix(topic, prefix) || len(parts) != 3 {
+		log.Errorf("app: bogus command topic: %s", topic)
+		return
+	}
+	id, namespace, command := parts[0], parts[1], parts[2]
+
+	// Most commands need a body, even if it is empty
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+
+	log.Debugf("app: command: player=%s, namespace=%s, command=%s", id, namespace, command)
+
+	result := CommandResult{Namespace: namespace, Command: command}
+	if !validCommandTopic(id, namespace, command) {
+		log.Errorf("app: bogus command: player=%s, namespace=%s, command=%s", id, namespace, command)
+		result.Error = "400"
+	} else if response, err := app.PostDataREST(id, namespace, command, payload); err != nil {
+		result.Error = err.Error()
+	} else if json.Valid(response) {
+		result.Response = response
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("app: unable to marshal command result for %s: %s", id, err.Error())
+		return
+	}
+
+	if app.mqttClient != nil {
+		app.publishTransient(fmt.Sprintf("%s/command/player/%s/result", app.config.MQTT.Topic, id), body)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMQTTCommand(t *testing.T) {
+	fake := newFakeSonosPlayer(t)
+	defer fake.Close()
+
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.Sonos.ApiKey = "KEY"
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", fake.groupsResponse(), 0)
+
+	app.handleCommand("sonos/command/player/P1/playerVolume/setMute", []byte(`{"muted":true}`))
+	if body := client.WaitForTopic(t, "sonos/command/player/P1/result"); string(body) != `{"namespace":"playerVolume","command":"setMute","response":{}}` {
+		t.Errorf("bogus command result: %s", string(body))
+	}
+
+	app.handleCommand("sonos/command/player/P9/playerVolume/setMute", nil)
+	if body := client.WaitForTopic(t, "sonos/command/player/P9/result"); string(body) != `{"namespace":"playerVolume","command":"setMute","error":"404"}` {
+		t.Errorf("bogus unknown player result: %s", string(body))
+	}
+
+	// Anything that doesn't look like an id, namespace, or command never makes it to the player
+	app.handleCommand("sonos/command/player/P2/..%2F..%2Finfo/setMute", nil)
+	if body := client.WaitForTopic(t, "sonos/command/player/P2/result"); string(body) != `{"namespace":"..%2F..%2Finfo","command":"setMute","error":"400"}` {
+		t.Errorf("bogus namespace result: %s", string(body))
+	}
+
+	app.handleCommand("sonos/command/player/P1?x=1/playerVolume/setMute", nil)
+	if body := client.WaitForTopic(t, "sonos/command/player/P1?x=1/result"); string(body) != `{"namespace":"playerVolume","command":"setMute","error":"400"}` {
+		t.Errorf("bogus id result: %s", string(body))
+	}
+}
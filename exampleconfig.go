@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//
+// Example config generation.  We walk the Config struct and spit out every field with its doc tag as a
+// comment and its default as the value.  This keeps the example in sync with the code, which the README
+// does not manage to do.
+//
+
+// writeExampleConfig writes a commented YAML config file containing every field in config
+func writeExampleConfig(w io.Writer, config Config) error {
+	fmt.Fprintf(w, "# Example sonosmqtt config.  Values are the defaults.\n")
+	return writeExampleStruct(w, reflect.ValueOf(config), 0)
+}
+
+func writeExampleStruct(w io.Writer, v reflect.Value, indent int) error {
+	prefix := strings.Repeat("  ", indent)
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+
+		if doc := field.Tag.Get("doc"); len(doc) > 0 {
+			fmt.Fprintf(w, "%s# %s\n", prefix, doc)
+		}
+
+		// Structs get their own section, everything else gets marshaled as is
+		if field.Type.Kind() == reflect.Struct {
+			fmt.Fprintf(w, "%s%s:\n", prefix, name)
+			if err := writeExampleStruct(w, v.Field(i), indent+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		out, err := yaml.Marshal(map[string]interface{}{name: v.Field(i).Interface()})
+		if err != nil {
+			return err
+		}
+
+		for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+			fmt.Fprintf(w, "%s%s\n", prefix, line)
+		}
+	}
+
+	return nil
+}
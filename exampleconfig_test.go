@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExampleConfigRoundTrip(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+
+	if err := writeExampleConfig(buffer, defaultConfig()); err != nil {
+		t.Fatalf("unable to write example config: %s", err.Error())
+	}
+
+	config := Config{}
+	if err := yaml.UnmarshalStrict(buffer.Bytes(), &config); err != nil {
+		t.Fatalf("unable to parse example config: %s", err.Error())
+	}
+
+	expected := defaultConfig()
+	if config.Sonos.ScanTime != expected.Sonos.ScanTime || config.WebServer.Port != expected.WebServer.Port {
+		t.Errorf("defaults did not survive the trip")
+	}
+
+	if !reflect.DeepEqual(config.Sonos.Subscriptions, expected.Sonos.Subscriptions) {
+		t.Errorf("subscriptions did not survive the trip: %v", config.Sonos.Subscriptions)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import sonos "github.com/swmerc/sonosmqtt/sonos"
+import (
+	log "github.com/sirupsen/logrus"
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
 
 // Group contains the information required to turn group events into individual player events.
 //
@@ -8,8 +11,11 @@ import sonos "github.com/swmerc/sonosmqtt/sonos"
 // this data to the other players.  Note that I left the cooridinator in the map of players
 // to make it easier to iterate over at the expense of a little data.
 //
-// Note that we have a TON of copies of the PlayerId for now (and perhaps always).  Oh well.
+// Note that we have a TON of copies of the PlayerId for now (and perhaps always).  Oh well.  The
+// Id and Name are the Sonos group id and name, which we need for group commands and topology.
 type Group struct {
+	Id          string
+	Name        string
 	Coordinator Player
 	Players     map[string]Player
 }
@@ -19,19 +25,41 @@ type Group struct {
 // This is used internally to track the group/player relationships instead of using the Sonos
 // data structtures.  I suppose I should make a proper type for the map[string]Group stuff at
 // some point.
-func getGroupMap(hhid string, groupsResponse sonos.GroupsResponse) (map[string]Group, error) {
+//
+// If maxPlayers is non-zero, players past the limit are logged and dropped.  Groups whose
+// coordinator was dropped are dropped along with it.
+func getGroupMap(hhid string, groupsResponse sonos.GroupsResponse, maxPlayers int) (map[string]Group, error) {
 	var allPlayers map[string]Player = make(map[string]Player, 32)
 	var allGroups map[string]Group = make(map[string]Group, 32)
 
 	// Stash all of the players
 	for _, p := range groupsResponse.Players {
+		if maxPlayers > 0 && len(allPlayers) >= maxPlayers {
+			log.Errorf("groups: player limit of %d reached, ignoring %s (%s)", maxPlayers, p.Name, p.Id)
+			continue
+		}
 		player := NewInternalPlayerFromSonosPlayer(p, hhid, "") // We don't know GroupId yet
 		allPlayers[player.GetId()] = player
 	}
 
+	// Sonos can briefly list a player in two groups while regrouping.  Coordinators always belong to
+	// their own group, and other players belong to the first group that lists them.  Anything else is
+	// logged and skipped so a player never ends up in two groups.
+	assigned := make(map[string]string, len(allPlayers))
+	for _, group := range groupsResponse.Groups {
+		if _, ok := allPlayers[group.CoordinatorId]; !ok {
+			continue
+		}
+		if groupId, ok := assigned[group.CoordinatorId]; ok {
+			log.Errorf("groups: %s coordinates both %s and %s, ignoring %s", group.CoordinatorId, groupId, group.Id, group.Id)
+			continue
+		}
+		assigned[group.CoordinatorId] = group.Id
+	}
+
 	// Process the groups and create them from the players
 	for _, group := range groupsResponse.Groups {
-		if coordinator, ok := allPlayers[group.CoordinatorId]; ok {
+		if coordinator, ok := allPlayers[group.CoordinatorId]; ok && assigned[group.CoordinatorId] == group.Id {
 
 			// We now know groupId.  This is good because we need it for the command headers later.
 			//
@@ -40,13 +68,20 @@ func getGroupMap(hhid string, groupsResponse sonos.GroupsResponse) (map[string]G
 
 			players := make(map[string]Player, 32)
 			for _, playerId := range group.PlayerIds {
+				if groupId, ok := assigned[playerId]; ok && groupId != group.Id {
+					log.Errorf("groups: %s is in both %s and %s, ignoring it in %s", playerId, groupId, group.Id, group.Id)
+					continue
+				}
 				if player, ok := allPlayers[playerId]; ok {
+					assigned[playerId] = group.Id
 					player.SetCoordinator(coordinator, group.Id)
 					players[player.GetId()] = player
 				}
 			}
 
 			newGroup := Group{
+				Id:          group.Id,
+				Name:        group.Name,
 				Coordinator: coordinator,
 				Players:     players,
 			}
@@ -57,6 +92,22 @@ func getGroupMap(hhid string, groupsResponse sonos.GroupsResponse) (map[string]G
 	return allGroups, nil
 }
 
+// findGroupForPlayer returns the group that contains the player.  The map is indexed by coordinator,
+// so this is a quick lookup for coordinators and a walk for everyone else.
+func findGroupForPlayer(groups map[string]Group, id string) (Group, bool) {
+	if group, ok := groups[id]; ok {
+		return group, true
+	}
+
+	for _, group := range groups {
+		if _, ok := group.Players[id]; ok {
+			return group, true
+		}
+	}
+
+	return Group{}, false
+}
+
 // groupsAreCloseEnoughForMe() returns true if two group maps match.
 func groupsAreCloseEnoughForMe(a, b map[string]Group) bool {
 
@@ -79,9 +130,11 @@ func groupsAreCloseEnoughForMe(a, b map[string]Group) bool {
 			return false
 		}
 
-		// Walk the players.  Almost done.
-		for id := range group.Players {
-			if _, ok := groupMatch.Players[id]; !ok {
+		// Walk the players.  Almost done.  A player that moved to a new address counts as a
+		// change since we need a new websocket.
+		for id, player := range group.Players {
+			playerMatch, ok := groupMatch.Players[id]
+			if !ok || playerMatch.GetWebsocketUrl() != player.GetWebsocketUrl() {
 				return false
 			}
 		}
@@ -90,16 +143,15 @@ func groupsAreCloseEnoughForMe(a, b map[string]Group) bool {
 	return true
 }
 
+// missingGroups returns the coordinators that no longer have a group.  Group topics are named after the
+// coordinator, so that is what RemoveStaleTopics wants.
 func missingGroups(old, new map[string]Group) []string {
 	var missing = make([]string, 0, 32)
 
-	for id, origGroup := range old {
-		if newGroup, ok := new[id]; ok {
-			if newGroup.Coordinator.GetGroupId() == origGroup.Coordinator.GetGroupId() {
-				continue
-			}
+	for id := range old {
+		if _, ok := new[id]; !ok {
+			missing = append(missing, id)
 		}
-		missing = append(missing, origGroup.Coordinator.GetGroupId())
 	}
 
 	return missing
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+// A small household: one group with two players, and one standalone player
+func newTestGroupsResponse() sonos.GroupsResponse {
+	return sonos.GroupsResponse{
+		Groups: []sonos.Group{
+			{Id: "P1:1", Name: "Kitchen + Den", CoordinatorId: "P1", PlayerIds: []string{"P1", "P2"}},
+			{Id: "P3:1", Name: "Office", CoordinatorId: "P3", PlayerIds: []string{"P3"}},
+		},
+		Players: []sonos.Player{
+			{Id: "P1", Name: "Kitchen", WebsocketUrl: "wss://1.2.3.1:1443/websocket/api"},
+			{Id: "P2", Name: "Den", WebsocketUrl: "wss://1.2.3.2:1443/websocket/api"},
+			{Id: "P3", Name: "Office", WebsocketUrl: "wss://1.2.3.3:1443/websocket/api"},
+		},
+	}
+}
+
+func TestGetGroupMap(t *testing.T) {
+	groups, err := getGroupMap("HHID", newTestGroupsResponse(), 0)
+	if err != nil {
+		t.Fatalf("getGroupMap failed: %s", err.Error())
+	}
+
+	if len(groups) != 2 {
+		t.Errorf("wrong number of groups: %d instead of 2", len(groups))
+	}
+
+	group, ok := groups["P1"]
+	if !ok || len(group.Players) != 2 {
+		t.Fatalf("group P1 missing or wrong size")
+	}
+
+	if group.Id != "P1:1" || group.Name != "Kitchen + Den" {
+		t.Errorf("wrong group id or name: %s, %s", group.Id, group.Name)
+	}
+}
+
+func TestGetGroupMapMaxPlayers(t *testing.T) {
+	groups, err := getGroupMap("HHID", newTestGroupsResponse(), 2)
+	if err != nil {
+		t.Fatalf("getGroupMap failed: %s", err.Error())
+	}
+
+	if players := getPlayers(groups); len(players) != 2 {
+		t.Errorf("wrong number of players: %d instead of 2", len(players))
+	}
+
+	if _, ok := groups["P3"]; ok {
+		t.Errorf("group P3 should have been dropped")
+	}
+}
+
+func TestGroupsMovedPlayer(t *testing.T) {
+	response := newTestGroupsResponse()
+	before, _ := getGroupMap("HHID", response, 0)
+	same, _ := getGroupMap("HHID", response, 0)
+
+	if !groupsAreCloseEnoughForMe(before, same) {
+		t.Errorf("identical groups do not match")
+	}
+
+	response.Players[1].WebsocketUrl = "wss://1.2.3.22:1443/websocket/api"
+	after, _ := getGroupMap("HHID", response, 0)
+
+	if groupsAreCloseEnoughForMe(before, after) {
+		t.Errorf("player moved but the groups still match")
+	}
+}
+
+func TestGetGroupMapDuplicatePlayers(t *testing.T) {
+	// P2 shows up in both groups, and P1 shows up as a member of P3's group
+	response := newTestGroupsResponse()
+	response.Groups[1].PlayerIds = []string{"P3", "P2", "P1"}
+
+	groups, err := getGroupMap("HHID", response, 0)
+	if err != nil {
+		t.Fatalf("getGroupMap failed: %s", err.Error())
+	}
+
+	if len(groups["P1"].Players) != 2 || len(groups["P3"].Players) != 1 {
+		t.Errorf("wrong group sizes: P1=%d, P3=%d", len(groups["P1"].Players), len(groups["P3"].Players))
+	}
+
+	if id := groups["P1"].Players["P2"].GetGroupId(); id != "P1:1" {
+		t.Errorf("P2 has the wrong group id: %s", id)
+	}
+
+	if id := groups["P1"].Coordinator.GetGroupId(); id != "P1:1" {
+		t.Errorf("P1 has the wrong group id: %s", id)
+	}
+
+	if players := getPlayers(groups); len(players) != 3 {
+		t.Errorf("wrong number of players: %d instead of 3", len(players))
+	}
+}
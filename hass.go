@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Home Assistant MQTT discovery.  If hass_discovery is set we publish a retained config for every player to
+// {prefix}/media_player/{playerId}/config so the players show up in Home Assistant without any YAML.  The
+// config just points at topics we already publish:
+//
+//   {base}/player/{playerId}/state         for the playback state and attributes
+//   {base}/player/{playerId}/availability  for online/offline
+//
+// There are no command topics yet, so the entities are read-only.  The discovery config is always JSON,
+// even if format is msgpack, but the state topic is not, so don't mix msgpack with discovery.
+//
+
+type HassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type HassDiscovery struct {
+	Name                 string     `json:"name"`
+	UniqueId             string     `json:"unique_id"`
+	StateTopic           string     `json:"state_topic"`
+	ValueTemplate        string     `json:"value_template"`
+	JSONAttributesTopic  string     `json:"json_attributes_topic"`
+	AvailabilityTopic    string     `json:"availability_topic"`
+	AvailabilityTemplate string     `json:"availability_template"`
+	Device               HassDevice `json:"device"`
+}
+
+// hassPrefix returns the discovery prefix, which is homeassistant unless someone changed it in HA
+func (app *App) hassPrefix() string {
+	if app.config.Sonos.HassPrefix == "" {
+		return "homeassistant"
+	}
+	return app.config.Sonos.HassPrefix
+}
+
+// hassTopic returns the discovery topic for a player
+func (app *App) hassTopic(id string) string {
+	return fmt.Sprintf("%s/media_player/%s/config", app.hassPrefix(), id)
+}
+
+// isHassTopic returns true for discovery topics, which must stay JSON no matter what format says
+func (app *App) isHassTopic(topic string) bool {
+	return app.config.Sonos.HassDiscovery && strings.HasPrefix(topic, app.hassPrefix()+"/")
+}
+
+// hassDiscoveryFor builds the discovery config for a player
+func (app *App) hassDiscoveryFor(player Player) HassDiscovery {
+	stateTopic := app.topicFor("player", player.GetId(), "", "state")
+
+	return HassDiscovery{
+		Name:                 player.GetName(),
+		UniqueId:             fmt.Sprintf("sonosmqtt_%s", player.GetId()),
+		StateTopic:           stateTopic,
+		ValueTemplate:        "{{ value_json.playbackState }}",
+		JSONAttributesTopic:  stateTopic,
+		AvailabilityTopic:    app.topicFor("player", player.GetId(), "", "availability"),
+		AvailabilityTemplate: "{{ 'online' if value_json.online else 'offline' }}",
+		Device: HassDevice{
+			Identifiers:  []string{player.GetId()},
+			Name:         player.GetName(),
+			Manufacturer: "Sonos",
+		},
+	}
+}
+
+// publishHassDiscovery publishes the discovery config for every player in the groups.  Dedup keeps this
+// from republishing the same thing on every groups event.
+func (app *App) publishHassDiscovery(groups map[string]Group) {
+	if !app.config.Sonos.HassDiscovery || app.mqttClient == nil {
+		return
+	}
+
+	for _, group := range groups {
+		for id, player := range group.Players {
+			body, err := marshalWithNoHtmlEscape(app.hassDiscoveryFor(player))
+			if err != nil {
+				log.Errorf("app: unable to marshal discovery for %s: %s", id, err.Error())
+				continue
+			}
+			app.PublishEventToTopic(app.hassTopic(id), body)
+		}
+	}
+}
+
+// clearHassDiscovery removes the discovery config for every player we published it for, and waits
+// for it since we are about to disconnect
+func (app *App) clearHassDiscovery() {
+	if !app.config.Sonos.HassDiscovery || app.mqttClient == nil {
+		return
+	}
+
+	app.publishLock.Lock()
+	topics := make([]string, 0, 32)
+	for topic := range app.mqttCache {
+		if app.isHassTopic(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	for _, topic := range topics {
+		app.uncacheTopic(topic)
+	}
+	app.publishLock.Unlock()
+
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if token := app.mqttClient.Publish(topic, 1, true, ""); !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+			log.Errorf("app: unable to clear %s", topic)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHassDiscovery(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.Format = "msgpack"
+	config.Sonos.HassDiscovery = true
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.publishHassDiscovery(app.groups)
+
+	// Always JSON, even with msgpack
+	discovery := HassDiscovery{}
+	if err := json.Unmarshal(client.WaitForTopic(t, "homeassistant/media_player/P2/config"), &discovery); err != nil {
+		t.Fatalf("discovery is not JSON: %s", err.Error())
+	}
+	if discovery.Name != "Den" || discovery.StateTopic != "sonos/player/P2/state" || discovery.AvailabilityTopic != "sonos/player/P2/availability" {
+		t.Errorf("bogus discovery: %+v", discovery)
+	}
+
+	// Players that go away lose their config
+	app.RemoveStaleTopics([]string{"P2"}, []string{})
+	if body := client.WaitForTopic(t, "homeassistant/media_player/P2/config"); len(body) != 0 {
+		t.Errorf("P2 discovery was not cleared: %s", string(body))
+	}
+
+	// And everyone else loses theirs on shutdown
+	app.Shutdown(0)
+	for _, id := range []string{"P1", "P3"} {
+		if body := client.WaitForTopic(t, "homeassistant/media_player/"+id+"/config"); len(body) != 0 {
+			t.Errorf("%s discovery was not cleared: %s", id, string(body))
+		}
+	}
+}
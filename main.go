@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -14,38 +21,140 @@ import (
 )
 
 // Config defines the server options we support in the config file.  Who knew?
+//
+// The doc tags are used to generate the example config (see exampleconfig.go), so keep them up to date.
 type Config struct {
-	// Log level
-	Debug bool `yaml:"debug"`
+	// Log level.  debug also turns on the debug-only bits of the API, and forces the level to at least debug.
+	Debug     bool   `yaml:"debug" doc:"Set to true to get overly verbose debug messages"`
+	LogLevel  string `yaml:"log_level" doc:"trace, debug, info, warn or error"`
+	LogFormat string `yaml:"log_format" doc:"text, or json for shipping logs somewhere that wants structure"`
 
 	// Sonos options
 	Sonos struct {
-		ApiKey      string `yaml:"apikey"`
-		HouseholdId string `yaml:"household"` // Filter to households with this if provided
+		ApiKey      string `yaml:"apikey" doc:"Required, and can be obtained from Sonos"`
+		HouseholdId string `yaml:"household" doc:"Only track players from this household if provided"`
 
 		// Things to subscribe to
 		Subscriptions struct {
-			Group []string `yaml:"group"`
+			Group  []string `yaml:"group" doc:"Namespaces subscribed to on every group coordinator"`
+			Player []string `yaml:"player" doc:"Namespaces subscribed to on every player"`
 		} `yaml:"subscriptions"`
 
+		// Namespaces we GET via REST after connecting so the topics start out full
+		Fetch []string `yaml:"fetch" doc:"Namespaces fetched via REST and published after connecting"`
+
 		// Simplify makes some messages easier to parse
-		Simplify bool `yaml:"simplify"`
+		Simplify bool `yaml:"simplify" doc:"Set to true to simplify events before publishing"`
+
+		// Optional names to use for playback states when simplifying (PLAYBACK_STATE_PAUSED -> paused)
+		PlaybackStates map[string]string `yaml:"playbackstates" doc:"Names to publish for Sonos playback states when simplifying"`
+
+		// Publish {base}/group/{id}/playbackTransition when a group starts or stops playing
+		Transitions bool `yaml:"transitions" doc:"Publish a playbackTransition topic when a group's playback state changes"`
 
 		// Geekier stuff.  May go away.
-		ScanTime uint `yaml:"scantime"` // Time to wait for mDNS responses.  Defaults to 5 seconds.
-		FanOut   bool `yaml:"fanout"`   // True to copy coordinator events to players
+		ScanTime     uint `yaml:"scantime" doc:"Seconds to wait for mDNS responses"`
+		FanOut       bool `yaml:"fanout" doc:"Copy coordinator events to players.  Forced on by simplify unless coordinatoronly is set."`
+		MaxPlayers   int  `yaml:"maxplayers" doc:"Maximum number of players to track.  0 means no limit."`
+		DrainTime    uint `yaml:"draintime" doc:"Seconds to wait for outstanding commands on shutdown"`
+		MaxFailures  int  `yaml:"maxfailures" doc:"Websocket failures in a row before we give up on a player.  0 means never."`
+		OpenWorkers  int  `yaml:"openworkers" doc:"Websockets opened in parallel when the groups change"`
+		EventBuffer  int  `yaml:"eventbuffer" doc:"Events and errors queued up from the websockets before they have to wait for us"`
+		GroupsSettle uint `yaml:"groupssettle" doc:"Milliseconds groups events must stop changing before we rebuild.  0 rebuilds right away."`
+		ErrorSettle  uint `yaml:"errorsettle" doc:"Milliseconds to wait after a websocket error.  One failed player is reconnected, more rebuilds.  0 rebuilds right away."`
+		UseProxy     bool `yaml:"useproxy" doc:"Reach players through the proxy in HTTP_PROXY/HTTPS_PROXY.  Applies to REST and websockets."`
+
+		// The players advertise whatever api version their firmware likes, and we rewrite everything to this
+		ApiVersion string `yaml:"apiversion" doc:"Sonos api version to talk to the players with, v1 or v2"`
+
+		// A single player that won't come back is retried with a backoff (1s, 2s, 4s, ...) before we give
+		// up and rebuild everything
+		ReconnectAttempts   int  `yaml:"reconnectattempts" doc:"Failed reconnects in a row before we give up on a single player and rebuild"`
+		ReconnectBackoffMax uint `yaml:"reconnectbackoffmax" doc:"Max seconds between reconnect attempts for a single player"`
+
+		// Cache REST GETs from the webserver for a bit so a dashboard polling us doesn't hammer the players
+		RestCacheTTL uint `yaml:"restcachettl" doc:"Milliseconds to cache REST GETs made via the API.  Events for the namespace clear it.  0 turns it off."`
+
+		// Subscribing to groups on more than one player keeps the topology coming if one of them goes away
+		GroupsSources int `yaml:"groupssources" doc:"Number of players to subscribe to groups on.  Duplicate events are dropped."`
+
+		// Check the player certs.  Off by default since the players don't have certs anything trusts.
+		VerifyTLS  bool   `yaml:"verifytls" doc:"Verify player certificates for REST and websockets"`
+		CACertFile string `yaml:"cacertfile" doc:"PEM file with the CA(s) to verify player certificates against.  Empty uses the system CAs."`
+
+		// Only publish group events to the coordinator, even if simplify would normally turn on fanout
+		CoordinatorOnly bool `yaml:"coordinatoronly" doc:"Never copy group events to players, even with simplify set"`
+
+		// Home Assistant discovery, so the players show up as media_player entities on their own
+		HassDiscovery bool   `yaml:"hass_discovery" doc:"Publish Home Assistant discovery configs for every player"`
+		HassPrefix    string `yaml:"hass_prefix" doc:"Home Assistant discovery prefix"`
 	} `yaml:"sonos"`
 
 	// MQTT broker-isms
 	MQTT struct {
 		Config MQTTConfig `yaml:"broker"`
-		Topic  string     `yaml:"topic"`
+		Topic  string     `yaml:"topic" doc:"Required, base topic to put Sonos MQTT content on"`
+
+		// Include the namespace in event topics ({namespace}/{type} instead of {type})
+		NamespaceInPath bool `yaml:"namespaceinpath" doc:"Publish events to {namespace}/{type} instead of {type}"`
+
+		// Go text/template for player, group and household topics.  Empty gives the usual topics.
+		TopicTemplate string `yaml:"topictemplate" doc:"Template for event topics, with {{.Base}}, {{.Scope}}, {{.Id}}, {{.Name}}, {{.Namespace}} and {{.Type}}"`
+
+		// Wrap events in {"headers": {...}, "body": {...}} so they make sense without the topic
+		Envelope bool `yaml:"envelope" doc:"Publish events as {headers, body} instead of just the body"`
+
+		// Payload format.  json is what Sonos sends, and msgpack is smaller for embedded subscribers.
+		// Whatever we use is published to {topic}/format so subscribers can tell.
+		Format string `yaml:"format" doc:"Payload format, json or msgpack"`
+
+		// Take commands from {topic}/command/player/{id}/{namespace}/{command}.  Off by default since
+		// anyone who can publish to the broker can then drive the players.
+		Commands bool `yaml:"commands" doc:"Accept player commands over MQTT on {topic}/command/player/..."`
+
+		// Don't publish a payload that matches what we last published to the topic, if the topic is retained
+		Dedup bool `yaml:"dedup" doc:"Skip retained publishes that are identical to the last one on the topic"`
+
+		// Some events show up with nothing in them.  Some folks like to see those as "cleared", and
+		// others just see noise and retained topics that never had anything useful on them.
+		SkipEmpty bool `yaml:"skipempty" doc:"Do not publish events whose body is empty or {}"`
+
+		// How we publish by default.  qos was already taken by the overrides, hence defaultqos.
+		DefaultQoS byte `yaml:"defaultqos" doc:"QoS (0-2) to publish with unless a qos rule says otherwise"`
+		Retain     bool `yaml:"retain" doc:"Retain what we publish unless a qos rule says otherwise"`
+
+		// QoS and retain overrides.  The first rule that matches the topic and/or event type wins, and
+		// anything that does not match is published with defaultqos and retain.
+		QoS []TopicQoS `yaml:"qos" doc:"Topic/type patterns and the QoS and retain to publish them with.  First match wins, default is defaultqos and retain."`
+
+		// Topic patterns we are allowed to publish to.  Anything else is dropped.  Empty allows everything.
+		Allow []string `yaml:"allow" doc:"Topic patterns we are allowed to publish to.  Empty allows everything."`
+
+		// Tell subscribers which players and groups went stale when we shut down.  If we vanish instead
+		// the will on {topic}/bridge/state says so.
+		Stale bool `yaml:"stale" doc:"Publish the players and groups that went stale to {topic}/stale when we go away"`
+
+		// We remember everything we publish so we can republish and clear it.  Topics come and go as
+		// groups change, so this is capped and the least recently published topics are thrown out.
+		CacheSize int `yaml:"cachesize" doc:"Max topics to remember.  The oldest are cleared on the broker when full.  0 is unlimited."`
+
+		// Failed publishes are always counted, but only logged this often so a broker that hates us
+		// doesn't flood the log
+		FailureLogInterval uint `yaml:"failureloginterval" doc:"Seconds between log messages about failed publishes.  0 turns them off."`
 	} `yaml:"mqtt"`
 
 	// Web server
 	WebServer struct {
-		Port int `yaml:"port"`
+		Port        int  `yaml:"port" doc:"Port for the REST/websocket API.  Set to 0 to disable the webserver."`
+		LogRequests bool `yaml:"logrequests" doc:"Log every request that hits the API"`
+		Metrics     bool `yaml:"metrics" doc:"Serve Prometheus metrics on /metrics"`
 	} `yaml:"webserver"`
+
+	// Text to speech service for /say
+	TTS TTSConfig `yaml:"tts"`
+
+	// Limits and timeouts for the websockets to the players and from API users
+	Websocket WebsocketConfig `yaml:"websocket"`
 }
 
 // main entry point.  It just handles loading config and firing up the MQTT client
@@ -55,33 +164,174 @@ func main() {
 	var err error
 
 	// Command line args
-	cfgPath := flag.String("cfgpath", "config.yml", "Path to config file for the server")
+	cfgPath := flag.String("cfgpath", "config.yml", "Path to config file for the server.  - reads stdin, and http(s) URLs are fetched.")
+	exampleConfig := flag.Bool("example-config", false, "Print an example config file with all of the defaults and exit")
 	flag.Parse()
 
+	if *exampleConfig {
+		if err = writeExampleConfig(os.Stdout, defaultConfig()); err != nil {
+			log.Errorf("Unable to generate example config (%s)", err.Error())
+		}
+		return
+	}
+
 	// Config file
 	if config, err = loadConfigFile(*cfgPath); err != nil {
 		log.Errorf("Unable to load config from %s (%s)", *cfgPath, err.Error())
 		return
 	}
 
-	// Handle log level now that we've read the config
-	if config.Debug {
-		log.SetLevel(log.DebugLevel)
+	// Handle logging now that we've read the config
+	setupLogging(config)
+
+	// Simplify options
+	if config.Sonos.PlaybackStates != nil {
+		playbackStateNames = config.Sonos.PlaybackStates
+	}
+
+	// Talk to the players directly, ignoring any proxy in the environment, if asked to
+	if !config.Sonos.UseProxy {
+		playerProxy = nil
+	}
+
+	// Websocket limits
+	websocketConfig = config.Websocket
+
+	// Talk to the players with the api version we were asked to
+	apiVersion = config.Sonos.ApiVersion
+
+	// Check player certs if asked to
+	if playerTLSConfig, err = newPlayerTLSConfig(config.Sonos.VerifyTLS, config.Sonos.CACertFile); err != nil {
+		log.Errorf("Unable to load player CA certs (%s)", err.Error())
+		return
 	}
 
 	// MQTT client
 	mqttConfig = &config.MQTT.Config
-	if client, err = initMQTTClient(true); err != nil {
+	if client, err = initMQTTClient(true, bridgeStateTopic(config.MQTT.Topic)); err != nil {
 		log.Errorf("Unable to init MQTT client (%s)", err.Error())
 		return
 	}
 
-	// App and webserver
+	// App and webserver.  A port of 0 turns the webserver off for MQTT only setups.
 	app := NewApp(config, client)
-	StartWebServer(config.WebServer.Port, app)
 
-	// Kick it all off
-	app.run()
+	var srv *http.Server
+	var srvErrors <-chan error
+	if config.WebServer.Port != 0 {
+		srv, srvErrors = StartWebServer(config.WebServer.Port, config.WebServer.LogRequests, app)
+	} else {
+		log.Infof("app: webserver disabled")
+	}
+
+	// Kick it all off, and shut down cleanly when asked to
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go app.run()
+
+	// A dead webserver is not a reason to stop publishing to MQTT, so just complain about it.  Once
+	// it has failed the channel is set to nil, which blocks forever.
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case err, ok := <-srvErrors:
+			if ok {
+				log.Errorf("app: webserver failed, running without it: %s", err.Error())
+				srv = nil
+			}
+			srvErrors = nil
+		case sig = <-signals:
+		}
+	}
+	log.Infof("app: %s: shutting down", sig.String())
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Sonos.DrainTime)*time.Second)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("app: webserver shutdown: %s", err.Error())
+		}
+		cancel()
+	}
+
+	app.Shutdown(time.Duration(config.Sonos.DrainTime) * time.Second)
+	if client != nil {
+		publishBridgeState(client, bridgeStateTopic(config.MQTT.Topic), "offline")
+		client.Disconnect(250)
+	}
+}
+
+// defaultConfig returns a Config with all of the defaults applied
+func defaultConfig() Config {
+	config := Config{}
+	config.LogLevel = "info"
+	config.LogFormat = "text"
+	config.Sonos.ScanTime = 5
+	config.MQTT.Format = "json"
+	config.MQTT.CacheSize = 10000
+	config.MQTT.Dedup = true
+	config.MQTT.DefaultQoS = 1
+	config.MQTT.Retain = true
+	config.Sonos.DrainTime = 2
+	config.Sonos.OpenWorkers = 8
+	config.Sonos.EventBuffer = 256
+	config.Sonos.GroupsSettle = 500
+	config.Sonos.ErrorSettle = 2000
+	config.Sonos.ReconnectAttempts = 5
+	config.Sonos.ReconnectBackoffMax = 60
+	config.Sonos.UseProxy = true
+	config.Sonos.ApiVersion = "v1"
+	config.Sonos.GroupsSources = 2
+	config.Sonos.HassPrefix = "homeassistant"
+	config.Sonos.Subscriptions.Group = []string{"playbackExtended", "playbackSession"}
+	config.Sonos.Fetch = []string{"groupVolume", "playback"}
+	config.Sonos.Subscriptions.Player = []string{"audioClip", "playerVolume"}
+	config.MQTT.FailureLogInterval = 60
+	config.WebServer.Port = 8000
+	config.Websocket = websocketConfig
+	return config
+}
+
+// setupLogging sets the log level and format.  The config has already been checked, so bad values
+// can't get here.  debug: true still works, and wins if the level is less chatty than debug.
+func setupLogging(config Config) {
+	level, _ := log.ParseLevel(config.LogLevel)
+	if config.Debug && level < log.DebugLevel {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+
+	if config.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+// How long we wait for a config URL to respond
+const configFetchTimeout = 30 * time.Second
+
+// openConfigSource opens the config.  A path of - reads from stdin and http(s) URLs are fetched, which
+// is handy when a container gets its config from somewhere other than a mounted file.
+func openConfigSource(cfgPath string) (io.ReadCloser, error) {
+	if cfgPath == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	if !strings.HasPrefix(cfgPath, "http://") && !strings.HasPrefix(cfgPath, "https://") {
+		return os.Open(cfgPath)
+	}
+
+	client := &http.Client{Timeout: configFetchTimeout}
+	response, err := client.Get(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("fetching config: %s", response.Status)
+	}
+
+	return response.Body, nil
 }
 
 // loadConfigFile loads the config file from the given path and applies
@@ -90,12 +340,10 @@ func loadConfigFile(cfgPath string) (Config, error) {
 	var err error
 
 	// Apply defaults
-	config := Config{}
-	config.Sonos.ScanTime = 5
-	config.WebServer.Port = 8000
+	config := defaultConfig()
 
-	// Pull in content from the file
-	f, err := os.Open(cfgPath)
+	// Pull in content from the file (or stdin, or a URL)
+	f, err := openConfigSource(cfgPath)
 	if err != nil {
 		return config, err
 	}
@@ -111,10 +359,85 @@ func loadConfigFile(cfgPath string) (Config, error) {
 		}
 	}
 
+	// Make sure the QoS overrides make sense
+	if err == nil && config.MQTT.DefaultQoS > 2 {
+		err = fmt.Errorf("bad defaultqos: %d", config.MQTT.DefaultQoS)
+	}
+	if err == nil {
+		for _, q := range config.MQTT.QoS {
+			if q.Pattern == "" && q.Type == "" {
+				err = fmt.Errorf("QoS overrides need a pattern or a type")
+				break
+			}
+			if _, matchErr := path.Match(q.Pattern, ""); matchErr != nil {
+				err = fmt.Errorf("bad QoS topic pattern: %s", q.Pattern)
+				break
+			}
+			if _, matchErr := path.Match(q.Type, ""); matchErr != nil {
+				err = fmt.Errorf("bad QoS type pattern: %s", q.Type)
+				break
+			}
+			if q.QoS > 2 {
+				err = fmt.Errorf("bad QoS for %s%s: %d", q.Pattern, q.Type, q.QoS)
+				break
+			}
+		}
+	}
+
+	// Logging
+	if err == nil {
+		if _, levelErr := log.ParseLevel(config.LogLevel); levelErr != nil {
+			err = fmt.Errorf("bad log level: %s", config.LogLevel)
+		} else if config.LogFormat != "text" && config.LogFormat != "json" {
+			err = fmt.Errorf("bad log format: %s", config.LogFormat)
+		}
+	}
+
+	// Websockets need something to work with.  Pings go out at 90% of pong_wait, so it has to be at
+	// least a couple of seconds.
+	if err == nil && (config.Websocket.MaxMessageSize <= 0 || config.Websocket.PongWait < 2 || config.Websocket.WriteWait == 0) {
+		err = fmt.Errorf("bad websocket config: %+v", config.Websocket)
+	}
+
+	// Negative buffers make no sense, and make() panics on them
+	if err == nil && config.Sonos.EventBuffer < 0 {
+		err = fmt.Errorf("bad eventbuffer: %d", config.Sonos.EventBuffer)
+	}
+
+	// Api version
+	if err == nil && config.Sonos.ApiVersion != "v1" && config.Sonos.ApiVersion != "v2" {
+		err = fmt.Errorf("bad api version: %s", config.Sonos.ApiVersion)
+	}
+
+	// Topic template
+	if err == nil {
+		if _, templateErr := newTopicTemplate(config.MQTT.TopicTemplate); templateErr != nil {
+			err = fmt.Errorf("bad topic template: %s", templateErr.Error())
+		}
+	}
+
+	// Payload format
+	if err == nil && config.MQTT.Format != "json" && config.MQTT.Format != "msgpack" {
+		err = fmt.Errorf("bad payload format: %s", config.MQTT.Format)
+	}
+
+	// Same for the allowlist
+	if err == nil {
+		for _, pattern := range config.MQTT.Allow {
+			if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+				err = fmt.Errorf("bad allowed topic pattern: %s", pattern)
+				break
+			}
+		}
+	}
+
 	// Automatically flip fanout if simplify is selected (for now)
 	//
-	// I'll pull fanout out of the code once I'm sure this is how I want it to work.
-	if config.Sonos.Simplify {
+	// I'll pull fanout out of the code once I'm sure this is how I want it to work.  Folks that find
+	// the per-player copies noisy can turn it off for good with coordinatoronly.
+	if config.Sonos.CoordinatorOnly {
+		config.Sonos.FanOut = false
+	} else if config.Sonos.Simplify {
 		if !config.Sonos.FanOut {
 			log.Infof("app: Setting fanout since simplify is set.")
 			config.Sonos.FanOut = true
@@ -126,19 +449,42 @@ func loadConfigFile(cfgPath string) (Config, error) {
 
 // MQTTConfig is the section of a config file that describes how to connect to a MQTT broker
 type MQTTConfig struct {
-	Client   string `yaml:"client"`
-	Host     string `yaml:"host"`
-	Port     uint32 `yaml:"port"`
-	TLS      bool   `yaml:"tls"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Client   string `yaml:"client" doc:"Required, name to use for this client on the MQTT server"`
+	Host     string `yaml:"host" doc:"Required, hostname or IP of MQTT server"`
+	Port     uint32 `yaml:"port" doc:"Required, port of MQTT server"`
+	TLS      bool   `yaml:"tls" doc:"Set to true to enable TLS"`
+	Username string `yaml:"username" doc:"Only valid if tls is true"`
+	Password string `yaml:"password" doc:"Only valid if tls is true"`
+}
+
+// TopicQoS overrides how we publish to topics that match it.  Pattern is a glob (as used by path.Match)
+// against the full topic, and Type is a glob against the event type (the last part of the topic).  If
+// both are set both have to match.  Retain is optional, and publishes are retained if it is not set.
+type TopicQoS struct {
+	Pattern string `yaml:"pattern"`
+	Type    string `yaml:"type"`
+	QoS     byte   `yaml:"qos"`
+	Retain  *bool  `yaml:"retain"`
 }
 
 // Yup, I need a better way to do this
 var mqttConfig *MQTTConfig = nil
 
-// initMQTTClient actually initializes the client
-func initMQTTClient(block bool) (mqtt.Client, error) {
+// bridgeStateTopic is where we say whether we are alive, online or offline
+func bridgeStateTopic(base string) string {
+	return fmt.Sprintf("%s/bridge/state", base)
+}
+
+// publishBridgeState publishes online or offline, and waits for it since we are likely about to disconnect
+func publishBridgeState(client mqtt.Client, topic string, state string) {
+	if token := client.Publish(topic, 1, true, state); !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		log.Errorf("mqtt: unable to publish %s to %s", state, topic)
+	}
+}
+
+// initMQTTClient actually initializes the client.  If stateTopic is set the broker publishes offline there
+// as our will if we vanish, and we publish online every time we connect.
+func initMQTTClient(block bool, stateTopic string) (mqtt.Client, error) {
 	if mqttConfig == nil {
 		return nil, fmt.Errorf("MQTT: no config")
 	}
@@ -179,6 +525,14 @@ func initMQTTClient(block bool) (mqtt.Client, error) {
 		opts.SetPassword(config.Password)
 	}
 
+	// Reconnects get the will set again, so publish online on every connect and not just the first
+	if len(stateTopic) > 0 {
+		opts.SetWill(stateTopic, "offline", 1, true)
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			go publishBridgeState(client, stateTopic, "online")
+		})
+	}
+
 	//
 	// We block if the broker is down. The only downside is that we hang here if we have a
 	// misconfigured MQTT broker.
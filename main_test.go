@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLoadConfigFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("sonos:\n  apikey: KEY\n  scantime: 7\n"))
+	}))
+	defer server.Close()
+
+	config, err := loadConfigFile(server.URL + "/config.yml")
+	if err != nil {
+		t.Fatalf("unable to load config from URL: %s", err.Error())
+	}
+
+	if config.Sonos.ApiKey != "KEY" || config.Sonos.ScanTime != 7 || config.Sonos.DrainTime != 2 {
+		t.Errorf("wrong config from URL: %v", config.Sonos)
+	}
+
+	if _, err := loadConfigFile(server.URL + "/missing.yml"); err == nil {
+		t.Errorf("missing config URL did not fail")
+	}
+}
+
+func TestLoadConfigQoS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad.yml" {
+			w.Write([]byte("sonos:\n  apikey: KEY\nmqtt:\n  defaultqos: 3\n"))
+			return
+		}
+		w.Write([]byte("sonos:\n  apikey: KEY\nmqtt:\n  retain: false\n"))
+	}))
+	defer server.Close()
+
+	config, err := loadConfigFile(server.URL + "/good.yml")
+	if err != nil || config.MQTT.DefaultQoS != 1 || config.MQTT.Retain {
+		t.Errorf("wrong QoS/retain: %d, %t, %v", config.MQTT.DefaultQoS, config.MQTT.Retain, err)
+	}
+
+	if _, err := loadConfigFile(server.URL + "/bad.yml"); err == nil {
+		t.Errorf("QoS of 3 was accepted")
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer log.SetFormatter(log.StandardLogger().Formatter)
+
+	config := defaultConfig()
+	config.LogLevel = "warn"
+	setupLogging(config)
+	if log.GetLevel() != log.WarnLevel {
+		t.Errorf("wrong level: %s", log.GetLevel())
+	}
+
+	// debug: true is still debug
+	config.Debug = true
+	setupLogging(config)
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("debug did not win: %s", log.GetLevel())
+	}
+
+	config.LogLevel = "trace"
+	config.LogFormat = "json"
+	setupLogging(config)
+	if log.GetLevel() != log.TraceLevel {
+		t.Errorf("debug made trace less chatty: %s", log.GetLevel())
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Errorf("not logging JSON")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//
+// Prometheus metrics for /metrics.  We can't pull in the Prometheus client here, and we only have a
+// handful of counters and gauges, so this writes the text exposition format by hand.  Everything is
+// counted all the time, and webserver.metrics only decides whether /metrics answers.
+//
+
+type Metrics struct {
+	lock            sync.Mutex
+	events          map[string]uint64
+	publishes       uint64
+	websocketErrors uint64
+	devicesFound    uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{events: map[string]uint64{}}
+}
+
+func (m *Metrics) countEvent(namespace string) {
+	m.lock.Lock()
+	m.events[namespace] = m.events[namespace] + 1
+	m.lock.Unlock()
+}
+
+func (m *Metrics) countPublish() {
+	m.lock.Lock()
+	m.publishes = m.publishes + 1
+	m.lock.Unlock()
+}
+
+func (m *Metrics) countWebsocketError() {
+	m.lock.Lock()
+	m.websocketErrors = m.websocketErrors + 1
+	m.lock.Unlock()
+}
+
+func (m *Metrics) countDeviceFound() {
+	m.lock.Lock()
+	m.devicesFound = m.devicesFound + 1
+	m.lock.Unlock()
+}
+
+// writeMetric writes one metric with its help and type.  Labelled metrics pass all of their values at once.
+func writeMetric(buf *bytes.Buffer, name string, kind string, help string, values map[string]uint64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fmt.Fprintf(buf, "%s%s %d\n", name, label, values[label])
+	}
+}
+
+// GetMetrics returns the metrics in the Prometheus text format, or a 404 if they are turned off
+func (app *App) GetMetrics() ([]byte, error) {
+	if !app.config.WebServer.Metrics {
+		return nil, fmt.Errorf("404")
+	}
+
+	buf := &bytes.Buffer{}
+
+	app.metrics.lock.Lock()
+	events := make(map[string]uint64, len(app.metrics.events))
+	for namespace, count := range app.metrics.events {
+		events[fmt.Sprintf("{namespace=%q}", namespace)] = count
+	}
+	publishes := app.metrics.publishes
+	websocketErrors := app.metrics.websocketErrors
+	devicesFound := app.metrics.devicesFound
+	app.metrics.lock.Unlock()
+
+	app.publishFailureLock.Lock()
+	publishFailures := app.publishFailures
+	app.publishFailureLock.Unlock()
+
+	var reconnects uint64
+	app.historyLock.Lock()
+	for _, history := range app.playerHistory {
+		reconnects = reconnects + history.Reconnects
+	}
+	app.historyLock.Unlock()
+
+	var groups, players, connected uint64
+	app.groupsLock.RLock()
+	groups = uint64(len(app.groups))
+	for _, group := range app.groups {
+		for _, player := range group.Players {
+			players = players + 1
+			if player.HasWebsocket() {
+				connected = connected + 1
+			}
+		}
+	}
+	app.groupsLock.RUnlock()
+
+	writeMetric(buf, "sonosmqtt_events_total", "counter", "Events received from players", events)
+	writeMetric(buf, "sonosmqtt_mqtt_publishes_total", "counter", "Payloads published to MQTT", map[string]uint64{"": publishes})
+	writeMetric(buf, "sonosmqtt_mqtt_publish_errors_total", "counter", "Publishes the broker did not accept", map[string]uint64{"": publishFailures})
+	writeMetric(buf, "sonosmqtt_websocket_errors_total", "counter", "Player websocket errors", map[string]uint64{"": websocketErrors})
+	writeMetric(buf, "sonosmqtt_websocket_reconnects_total", "counter", "Player websocket reconnects", map[string]uint64{"": reconnects})
+	writeMetric(buf, "sonosmqtt_mdns_devices_found_total", "counter", "Players found by mDNS scans", map[string]uint64{"": devicesFound})
+	writeMetric(buf, "sonosmqtt_groups", "gauge", "Groups we know about", map[string]uint64{"": groups})
+	writeMetric(buf, "sonosmqtt_players", "gauge", "Players we know about", map[string]uint64{"": players})
+	writeMetric(buf, "sonosmqtt_connected_players", "gauge", "Players with an open websocket", map[string]uint64{"": connected})
+
+	return buf.Bytes(), nil
+}
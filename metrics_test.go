@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	if _, err := app.GetMetrics(); err == nil || err.Error() != "404" {
+		t.Errorf("metrics served while turned off: %v", err)
+	}
+
+	app.config.WebServer.Metrics = true
+	app.metrics.countEvent("playback")
+	app.metrics.countEvent("playback")
+	app.metrics.countEvent("groups")
+	app.metrics.countPublish()
+	app.metrics.countDeviceFound()
+	app.playerConnected(app.groups["P1"], "P2")
+	app.playerFailed("P2", fmt.Errorf("closed"))
+	app.playerConnected(app.groups["P1"], "P2")
+
+	body, err := app.GetMetrics()
+	if err != nil {
+		t.Fatalf("no metrics: %s", err.Error())
+	}
+
+	for _, line := range []string{
+		"# TYPE sonosmqtt_events_total counter",
+		`sonosmqtt_events_total{namespace="groups"} 1`,
+		`sonosmqtt_events_total{namespace="playback"} 2`,
+		"sonosmqtt_mqtt_publishes_total 1",
+		"sonosmqtt_mqtt_publish_errors_total 0",
+		"sonosmqtt_websocket_reconnects_total 1",
+		"sonosmqtt_mdns_devices_found_total 1",
+		"sonosmqtt_groups 2",
+		"sonosmqtt_players 3",
+		"sonosmqtt_connected_players 0",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, string(body))
+		}
+	}
+}
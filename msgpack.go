@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+//
+// Just enough MessagePack to re-encode whatever JSON we were going to publish.  The bodies are opaque
+// JSON by the time they get to the publish path, so we decode them generically and write them back
+// out.  Map keys are sorted so the same JSON always turns into the same bytes.
+//
+
+// jsonToMsgpack converts a JSON document to MessagePack
+func jsonToMsgpack(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := writeMsgpack(&out, value); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func writeMsgpack(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		out.WriteByte(0xc0)
+
+	case bool:
+		if v {
+			out.WriteByte(0xc3)
+		} else {
+			out.WriteByte(0xc2)
+		}
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(out, i)
+		} else if f, err := v.Float64(); err == nil {
+			out.WriteByte(0xcb)
+			binary.Write(out, binary.BigEndian, math.Float64bits(f))
+		} else {
+			return err
+		}
+
+	case string:
+		writeMsgpackHeader(out, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		out.WriteString(v)
+
+	case []interface{}:
+		writeMsgpackHeader(out, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(out, item); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackHeader(out, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpack(out, key)
+			if err := writeMsgpack(out, v[key]); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("msgpack: unexpected type %T", value)
+	}
+
+	return nil
+}
+
+// writeMsgpackHeader writes the type and length for strings, arrays, and maps.  Short ones fit in
+// the type byte, and there is no 8 bit length for arrays and maps (code8 of 0).
+func writeMsgpackHeader(out *bytes.Buffer, length int, fix byte, fixMax int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case length <= fixMax:
+		out.WriteByte(fix | byte(length))
+	case code8 != 0 && length <= math.MaxUint8:
+		out.WriteByte(code8)
+		out.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		out.WriteByte(code16)
+		binary.Write(out, binary.BigEndian, uint16(length))
+	default:
+		out.WriteByte(code32)
+		binary.Write(out, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackInt(out *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		out.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		out.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		out.WriteByte(0xd0)
+		out.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		out.WriteByte(0xd1)
+		binary.Write(out, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		out.WriteByte(0xd2)
+		binary.Write(out, binary.BigEndian, int32(i))
+	default:
+		out.WriteByte(0xd3)
+		binary.Write(out, binary.BigEndian, i)
+	}
+}
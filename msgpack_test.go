@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJSONToMsgpack(t *testing.T) {
+	tests := map[string][]byte{
+		`null`:                 {0xc0},
+		`true`:                 {0xc3},
+		`5`:                    {0x05},
+		`-1`:                   {0xff},
+		`300`:                  {0xd1, 0x01, 0x2c},
+		`1.5`:                  {0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		`"hi"`:                 {0xa2, 'h', 'i'},
+		`[1,"a"]`:              {0x92, 0x01, 0xa1, 'a'},
+		`{"b":false,"a":null}`: {0x82, 0xa1, 'a', 0xc0, 0xa1, 'b', 0xc2},
+	}
+
+	for in, expected := range tests {
+		out, err := jsonToMsgpack([]byte(in))
+		if err != nil || !bytes.Equal(out, expected) {
+			t.Errorf("%s: got %x (%v), expected %x", in, out, err, expected)
+		}
+	}
+
+	if _, err := jsonToMsgpack([]byte("not json")); err == nil {
+		t.Errorf("bogus JSON was converted")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -33,6 +34,7 @@ type Player interface {
 
 	GetHouseholdId() string
 	GetGroupId() string
+	GetCoordinatorId() string
 	GetName() string
 
 	String() string
@@ -44,9 +46,18 @@ type Player interface {
 	// Temporary until we get real REST support
 	CreateFullRESTUrl(subpath string) string
 
+	// Players can move if their DHCP lease changes.  The address can only be updated while the
+	// websocket is down, and UpdateAddress returns true if it actually changed.
+	GetWebsocketUrl() string
+	UpdateAddress(websocketUrl string) bool
+
 	// Websocket support
 	InitWebsocketConnection(headers http.Header, eventHandler PlayerEventHandler) error
+	Reconnect() error
 	CloseWebsocketConnection()
+	HasWebsocket() bool
+	IsWebsocketConnected() bool
+	DrainCommands(timeout time.Duration) bool
 	SendCommandViaWebsocket(namespace string, command string, completion func(sonos.WebsocketResponse)) error
 	SendRequestViaWebsocket(request sonos.WebsocketRequest, callback func(sonos.WebsocketResponse)) error
 }
@@ -80,6 +91,18 @@ type playerImpl struct {
 	eventHandler PlayerEventHandler
 	cmdId        uint32
 
+	// Set while a websocket is being dialed so a second InitWebsocketConnection waits for it
+	// instead of dialing again
+	dialing *websocketDial
+
+	// When the websocket last came up and went down, for anyone keeping an eye on us
+	lastConnect    time.Time
+	lastDisconnect time.Time
+
+	// What we last connected with, so Reconnect can do it again
+	lastHeaders      http.Header
+	lastEventHandler PlayerEventHandler
+
 	cmdCallbackMap map[string]cmdCallback
 }
 
@@ -97,8 +120,8 @@ func NewInternalPlayerFromInfoResponse(info sonos.PlayerInfoResponse) Player {
 		groupId:        info.GroupId,
 		coordinatorId:  groupIdToCoordinatorId(info.GroupId),
 		householdId:    info.HouseholdId,
-		restUrl:        sonos.ConvertToApiVersion1(info.RestUrl),
-		websocketUrl:   sonos.ConvertToApiVersion1(info.WebsocketUrl),
+		restUrl:        sonos.ConvertToApiVersion(info.RestUrl, apiVersion),
+		websocketUrl:   sonos.ConvertToApiVersion(info.WebsocketUrl, apiVersion),
 		RWMutex:        sync.RWMutex{},
 		websocket:      nil,
 		eventHandler:   nil,
@@ -117,8 +140,8 @@ func NewInternalPlayerFromSonosPlayer(player sonos.Player, householdId string, g
 		groupId:        groupId,
 		coordinatorId:  groupIdToCoordinatorId(groupId),
 		householdId:    householdId,
-		restUrl:        restUrlFromWebsocketUrl(sonos.ConvertToApiVersion1(player.WebsocketUrl)),
-		websocketUrl:   sonos.ConvertToApiVersion1(player.WebsocketUrl),
+		restUrl:        restUrlFromWebsocketUrl(sonos.ConvertToApiVersion(player.WebsocketUrl, apiVersion)),
+		websocketUrl:   sonos.ConvertToApiVersion(player.WebsocketUrl, apiVersion),
 		RWMutex:        sync.RWMutex{},
 		websocket:      nil,
 		eventHandler:   nil,
@@ -127,6 +150,10 @@ func NewInternalPlayerFromSonosPlayer(player sonos.Player, householdId string, g
 	}
 }
 
+// apiVersion is the Sonos api version we talk to the players with.  The players advertise v1 or v2
+// depending on the firmware, and we rewrite every URL we get to this.  main sets it from the config.
+var apiVersion = "v1"
+
 //
 // Functions to cheat and create data that the API doesn't provide at the time it is needed
 //
@@ -165,17 +192,47 @@ func (p *playerImpl) GetGroupId() string {
 	return p.groupId
 }
 
+func (p *playerImpl) GetCoordinatorId() string {
+	return p.coordinatorId
+}
+
 func (p *playerImpl) String() string {
+	p.RLock()
+	defer p.RUnlock()
 	return fmt.Sprintf("name=%s, id=%s, groupid=%s, wsurl=%s, resturl=%s", p.Name, p.PlayerId, p.groupId, p.websocketUrl, p.restUrl)
 }
 
 func (p *playerImpl) CreateFullRESTUrl(subpath string) string {
-	// Yup, we assume V1 and local HH.  No idea why the LAN variant has multi HH support when the
+	// Yup, we assume local HH, and whatever api version the config asked for.  No idea why the LAN variant has multi HH support when the
 	// players do not.  Unless it is to match the cloud API, but the "local" bit makes it not match
 	// anyway.
 	//
 	// NOTE: We should move the code that talks to players in here and hide all of the Urls
-	return fmt.Sprintf("%s/v1/households/local%s", p.restUrl, subpath)
+	p.RLock()
+	defer p.RUnlock()
+	return fmt.Sprintf("%s/%s/households/local%s", p.restUrl, apiVersion, subpath)
+}
+
+func (p *playerImpl) GetWebsocketUrl() string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.websocketUrl
+}
+
+func (p *playerImpl) UpdateAddress(websocketUrl string) bool {
+	websocketUrl = sonos.ConvertToApiVersion(websocketUrl, apiVersion)
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.websocket != nil || websocketUrl == p.websocketUrl {
+		return false
+	}
+
+	log.Infof("player: %s: moved from %s to %s", p.PlayerId, p.websocketUrl, websocketUrl)
+	p.websocketUrl = websocketUrl
+	p.restUrl = restUrlFromWebsocketUrl(websocketUrl)
+	return true
 }
 
 func (p *playerImpl) SetCoordinator(coordinator Player, groupId string) {
@@ -187,33 +244,67 @@ func (p *playerImpl) SetCoordinator(coordinator Player, groupId string) {
 // Player websockets.  This will likely get split out.
 //
 
+// websocketDial is a dial in progress.  done is closed once err is set.
+type websocketDial struct {
+	done chan struct{}
+	err  error
+}
+
 func (p *playerImpl) InitWebsocketConnection(headers http.Header, eventHandler PlayerEventHandler) error {
-	// We only ever create websockets on one thread, but we currently remove them in OnClose() below
-	// so we need locking.  Weee.
-	p.RLock()
+	// We remove websockets in OnClose() below, and more than one goroutine can try to connect, so the
+	// check and the claim have to happen under the same lock.  We can't hold it while dialing since the
+	// websocket calls back into us, so anyone who shows up mid-dial waits for that dial instead.
+	p.Lock()
 	if p.websocket != nil {
-		p.RUnlock()
+		p.Unlock()
 		return nil
 	}
-	p.RUnlock()
+	if dial := p.dialing; dial != nil {
+		p.Unlock()
+		<-dial.done
+		return dial.err
+	}
+	dial := &websocketDial{done: make(chan struct{})}
+	p.dialing = dial
+	url := p.websocketUrl
+	p.Unlock()
 
 	// We point the callbacks to this object, which passes along things of interest to the
 	// event handler (which only contains events).  We'll likely have to add a Close handler
 	// so we can reach to players going away.
-	ws := websocketInitHook(p.websocketUrl, p.PlayerId, headers, p)
+	ws := websocketInitHook(url, p.PlayerId, headers, p)
 
-	if ws != nil {
-		p.Lock()
+	p.Lock()
+	// The websocket comes back even if the dial failed, so make sure it is actually running
+	if ws == nil || !ws.IsRunning() {
+		dial.err = fmt.Errorf("unable to create websocket for %s", p.PlayerId)
+	} else {
 		p.eventHandler = eventHandler
 		p.websocket = ws
-		p.Unlock()
+		p.lastConnect = time.Now()
+		p.lastHeaders = headers
+		p.lastEventHandler = eventHandler
 	}
+	p.dialing = nil
+	p.Unlock()
 
-	if ws == nil {
-		return fmt.Errorf("unable to create websocket for %s", p.PlayerId)
+	close(dial.done)
+	return dial.err
+}
+
+// Reconnect opens a new websocket with the same headers and event handler as the last one.  It is up to
+// the caller to subscribe to things again.
+func (p *playerImpl) Reconnect() error {
+	p.RLock()
+	headers := p.lastHeaders
+	eventHandler := p.lastEventHandler
+	p.RUnlock()
+
+	if eventHandler == nil {
+		return fmt.Errorf("player: %s: never connected", p.PlayerId)
 	}
 
-	return nil
+	return p.InitWebsocketConnection(headers, eventHandler)
 }
 
 func (p *playerImpl) CloseWebsocketConnection() {
@@ -224,6 +315,79 @@ func (p *playerImpl) CloseWebsocketConnection() {
 	p.RUnlock()
 }
 
+// HasWebsocket returns true until OnClose has run for the websocket
+func (p *playerImpl) HasWebsocket() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.websocket != nil
+}
+
+// IsWebsocketConnected returns true if the websocket is up and has not failed.  Unlike HasWebsocket it
+// goes false as soon as there is an error, since every error takes the websocket down with it.
+func (p *playerImpl) IsWebsocketConnected() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.isConnected()
+}
+
+// isConnected is IsWebsocketConnected for callers that already hold the lock
+func (p *playerImpl) isConnected() bool {
+	return p.websocket != nil && p.lastDisconnect.Before(p.lastConnect)
+}
+
+// ExportedPlayer is what callers see of a player over REST and MQTT
+type ExportedPlayer struct {
+	Id             string     `json:"id"`
+	Name           string     `json:"name"`
+	Connected      bool       `json:"connected"`
+	LastConnect    *time.Time `json:"lastConnect,omitempty"`
+	LastDisconnect *time.Time `json:"lastDisconnect,omitempty"`
+}
+
+// MarshalJSON hides everything but the ExportedPlayer bits
+func (p *playerImpl) MarshalJSON() ([]byte, error) {
+	p.RLock()
+	exported := ExportedPlayer{
+		Id:        p.PlayerId,
+		Name:      p.Name,
+		Connected: p.isConnected(),
+	}
+	if !p.lastConnect.IsZero() {
+		lastConnect := p.lastConnect
+		exported.LastConnect = &lastConnect
+	}
+	if !p.lastDisconnect.IsZero() {
+		lastDisconnect := p.lastDisconnect
+		exported.LastDisconnect = &lastDisconnect
+	}
+	p.RUnlock()
+
+	return json.Marshal(exported)
+}
+
+// DrainCommands waits up to timeout for outstanding commands to complete.  Returns true if they all
+// did.  Used on shutdown so commands that are about to finish are not failed when the websocket closes.
+func (p *playerImpl) DrainCommands(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		p.RLock()
+		pending := len(p.cmdCallbackMap)
+		p.RUnlock()
+
+		if pending == 0 {
+			return true
+		}
+
+		if !time.Now().Before(deadline) {
+			log.Infof("player: %s: %d commands still pending", p.PlayerId, pending)
+			return false
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func handleCmdTimeout(p *playerImpl, cmdId string, timer *time.Timer) {
 	// Wait for the timeout.  We'll cancel when we get a response.  Probably.
 	<-timer.C
@@ -258,20 +422,22 @@ func (p *playerImpl) SendRequestViaWebsocket(request sonos.WebsocketRequest, cal
 		return fmt.Errorf("player: %s: attempt to send with no websocket", p.PlayerId)
 	}
 
+	cmdId := fmt.Sprintf("%d", p.cmdId)
+
 	// Set up a timeout function
 	if callback != nil {
 		timer := time.NewTimer(playerCmdTimeout)
 
-		p.cmdCallbackMap[fmt.Sprintf("%d", p.cmdId)] = cmdCallback{
+		p.cmdCallbackMap[cmdId] = cmdCallback{
 			callback: callback,
 			timer:    timer,
 		}
 
-		go handleCmdTimeout(p, fmt.Sprintf("%d", p.cmdId), timer)
+		go handleCmdTimeout(p, cmdId, timer)
 	}
 
 	// Set and increment CmdId
-	request.Headers.CmdId = fmt.Sprintf("%d", p.cmdId)
+	request.Headers.CmdId = cmdId
 	p.cmdId = p.cmdId + 1
 
 	p.Unlock()
@@ -280,18 +446,45 @@ func (p *playerImpl) SendRequestViaWebsocket(request sonos.WebsocketRequest, cal
 	// Might as well convert to JSON, log, and send outside of the lock
 	//
 	msg, err := request.ToRawBytes()
-	if err != nil {
-		log.Errorf("player: send failed: %s", err.Error())
-		return nil
+	if err == nil {
+		err = ws.SendMessage(msg)
 	}
 
-	if err = ws.SendMessage(msg); err != nil {
+	if err != nil {
 		log.Errorf("player: send failed: %s", err.Error())
+		p.failCommand(cmdId, fmt.Sprintf("Send failed: %s", err.Error()))
+		return err
 	}
 
 	return nil
 }
 
+// failCommand tells the caller their command failed right now instead of making them wait for the
+// timeout.  It is a no-op if the response or timeout beat us to it.
+func (p *playerImpl) failCommand(cmdId string, reason string) {
+	p.Lock()
+	cmdCallback, ok := p.cmdCallbackMap[cmdId]
+	if ok {
+		cmdCallback.timer.Stop()
+		delete(p.cmdCallbackMap, cmdId)
+	}
+	p.Unlock()
+
+	if ok && cmdCallback.callback != nil {
+		response := sonos.WebsocketResponse{
+			Headers: sonos.ResponseHeaders{
+				CommonHeaders: sonos.CommonHeaders{},
+				Response:      reason,
+				Success:       false,
+				Type:          "none",
+			},
+			BodyJSON: []byte{},
+		}
+
+		cmdCallback.callback(response)
+	}
+}
+
 func (p *playerImpl) SendCommandViaWebsocket(namespace string, command string, callback func(sonos.WebsocketResponse)) error {
 
 	request := sonos.WebsocketRequest{
@@ -322,9 +515,10 @@ func (p *playerImpl) OnConnect(userData string) {
 }
 
 func (p *playerImpl) OnError(userData string, err error) {
-	p.RLock()
+	p.Lock()
 	eventHandler := p.eventHandler
-	p.RUnlock()
+	p.lastDisconnect = time.Now()
+	p.Unlock()
 
 	log.Infof("player: %s: error: %s", p.PlayerId, err.Error())
 	if eventHandler != nil {
@@ -332,9 +526,17 @@ func (p *playerImpl) OnError(userData string, err error) {
 	}
 }
 
-func (p *playerImpl) OnClose(userData string) {
+func (p *playerImpl) OnClose(userData string, reason CloseReason) {
 	p.Lock()
 
+	// If we didn't ask for this and there was no error, the player hung up on us (or just went quiet).
+	// Pass that along as an error, since the event handler needs to know either way.
+	eventHandler := p.eventHandler
+	report := !reason.Local && p.isConnected()
+
+	if p.isConnected() {
+		p.lastDisconnect = time.Now()
+	}
 	p.websocket = nil
 	p.eventHandler = nil
 
@@ -361,6 +563,45 @@ func (p *playerImpl) OnClose(userData string) {
 	for _, callback := range callbacks {
 		callback(response)
 	}
+
+	if report && eventHandler != nil {
+		eventHandler.OnError(userData, reason)
+	}
+}
+
+// Messages we could not parse.  If Sonos changes the message format this is the only clue we get, so
+// we count them and log a sample of what we got every so often.
+var parseFailures struct {
+	sync.Mutex
+	count   uint64
+	lastLog time.Time
+}
+
+const parseFailureLogInterval = time.Minute
+const parseFailureSampleSize = 256
+
+func countParseFailure(playerId string, msg []byte, err error) {
+	parseFailures.Lock()
+	defer parseFailures.Unlock()
+
+	parseFailures.count = parseFailures.count + 1
+	if time.Since(parseFailures.lastLog) < parseFailureLogInterval {
+		return
+	}
+	parseFailures.lastLog = time.Now()
+
+	sample := msg
+	if len(sample) > parseFailureSampleSize {
+		sample = sample[:parseFailureSampleSize]
+	}
+	log.Warnf("player: %s: unable to parse message (%d failures so far): %s: %s", playerId, parseFailures.count, err.Error(), string(sample))
+}
+
+// GetParseFailures returns the number of websocket messages we could not parse
+func GetParseFailures() uint64 {
+	parseFailures.Lock()
+	defer parseFailures.Unlock()
+	return parseFailures.count
 }
 
 func (p *playerImpl) OnMessage(userData string, msg []byte) {
@@ -371,7 +612,7 @@ func (p *playerImpl) OnMessage(userData string, msg []byte) {
 	// Parse the response
 	response := sonos.WebsocketResponse{}
 	if err := response.FromRawBytes(msg); err != nil {
-		log.Errorf("player: OnMessage: %s", err.Error())
+		countParseFailure(p.PlayerId, msg, err)
 		return
 	}
 
@@ -385,8 +626,12 @@ func (p *playerImpl) OnMessage(userData string, msg []byte) {
 		}
 		p.Unlock()
 
+		// Responses we aren't waiting for (the command timed out, or the player sent it twice) are
+		// dropped.  They are not events, so they don't go to the event handler either.
 		if ok {
 			cmdCallback.callback(response)
+		} else {
+			log.Debugf("player: %s: dropping response for unknown cmdId %s", p.PlayerId, response.Headers.CmdId)
 		}
 
 		return
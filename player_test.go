@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -126,6 +128,7 @@ type MockWebsocketClient struct {
 
 	// Control
 	respondToMessages bool
+	sendError         error
 }
 
 func newMockWebsocketClient() *MockWebsocketClient {
@@ -134,7 +137,7 @@ func newMockWebsocketClient() *MockWebsocketClient {
 		userData:          "",
 		message:           []byte{},
 		callbacks:         nil,
-		closed:            true,
+		closed:            false,
 		respondToMessages: true,
 	}
 
@@ -149,6 +152,9 @@ func newMockWebsocketClient() *MockWebsocketClient {
 }
 
 func (ws *MockWebsocketClient) SendMessage(data []byte) error {
+	if ws.sendError != nil {
+		return ws.sendError
+	}
 
 	request := sonos.WebsocketRequest{}
 	if err := request.FromRawBytes(data); err != nil {
@@ -185,7 +191,7 @@ func (ws *MockWebsocketClient) SendMessage(data []byte) error {
 
 func (ws *MockWebsocketClient) Close() {
 	ws.closed = true
-	ws.callbacks.OnClose(ws.userData)
+	ws.callbacks.OnClose(ws.userData, CloseReason{Local: true})
 }
 
 func (ws *MockWebsocketClient) IsRunning() bool {
@@ -285,6 +291,42 @@ func TestNewInternalPlayerFromSonosPlayer(t *testing.T) {
 	}
 }
 
+func TestConvertToApiVersion(t *testing.T) {
+	tests := []struct {
+		in       string
+		version  string
+		expected string
+	}{
+		{"https://1.2.3.4:1443/api/v2/players/local/info", "v1", "https://1.2.3.4:1443/api/v1/players/local/info"},
+		{"https://1.2.3.4:1443/api/v1/players/local/info", "v2", "https://1.2.3.4:1443/api/v2/players/local/info"},
+		{"https://1.2.3.4:1443/api/v1/players/local/info", "v1", "https://1.2.3.4:1443/api/v1/players/local/info"},
+		{"https://1.2.3.4:1443/api/v2/v2/info", "v1", "https://1.2.3.4:1443/api/v1/v2/info"},
+		{"wss://1.2.3.4:1443/websocket/api", "v2", "wss://1.2.3.4:1443/websocket/api"},
+	}
+
+	for _, test := range tests {
+		if out := sonos.ConvertToApiVersion(test.in, test.version); out != test.expected {
+			t.Errorf("%s to %s: %s instead of %s", test.in, test.version, out, test.expected)
+		}
+	}
+}
+
+func TestApiVersion2(t *testing.T) {
+	apiVersion = "v2"
+	defer func() { apiVersion = "v1" }()
+
+	info := sonos.PlayerInfoResponse{
+		PlayerId:     "PID",
+		RestUrl:      "https://1.2.3.4:1443/api",
+		WebsocketUrl: "wss://1.2.3.4:1443/websocket/api",
+	}
+
+	player := NewInternalPlayerFromInfoResponse(info)
+	if url := player.CreateFullRESTUrl("/blah"); url != "https://1.2.3.4:1443/api/v2/households/local/blah" {
+		t.Errorf("wrong REST URL: %s", url)
+	}
+}
+
 //
 // Websocket commnands, which are a wee bit more fun.  I'll start with a simple mock that just stashes the
 // content sent to the callbacks.
@@ -334,6 +376,34 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestSendFailure(t *testing.T) {
+	cheese := newCheesyTestStuff(t)
+
+	// A long timeout, so only an immediate failure gets us a response in time
+	cheese.SetCommandTimeout(10*time.Second, false)
+	cheese.websocketClient.sendError = fmt.Errorf("broken pipe")
+
+	err := cheese.player.SendCommandViaWebsocket("player", "getSettings", func(resp sonos.WebsocketResponse) {
+		cheese.responseChannel <- resp
+	})
+	if err == nil {
+		t.Errorf("send failure was swallowed")
+	}
+
+	select {
+	case response := <-cheese.responseChannel:
+		if response.Headers.Success || response.Headers.Response != "Send failed: broken pipe" {
+			t.Errorf("wrong response: %v", response.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("callback was not called")
+	}
+
+	if pending := len(cheese.player.(*playerImpl).cmdCallbackMap); pending != 0 {
+		t.Errorf("%d callbacks left behind", pending)
+	}
+}
+
 func TestCloseWithOutstandingCommands(t *testing.T) {
 	cheese := newCheesyTestStuff(t)
 
@@ -392,3 +462,238 @@ func TestEvents(t *testing.T) {
 		t.Errorf("bogus data: %s != blah", data.Data)
 	}
 }
+
+func TestDrainCommands(t *testing.T) {
+	cheese := newCheesyTestStuff(t)
+
+	// Nothing outstanding
+	if !cheese.player.DrainCommands(0) {
+		t.Errorf("drain failed with no commands")
+	}
+
+	// One command that never gets a response
+	cheese.SetCommandTimeout(1*time.Second, false)
+	cheese.SendCommand("player", "getSettings")
+
+	if cheese.player.DrainCommands(10 * time.Millisecond) {
+		t.Errorf("drain worked with an outstanding command")
+	}
+
+	cheese.CloseWebsocket()
+	cheese.GetResponse()
+}
+
+func TestUpdateAddress(t *testing.T) {
+	player := NewInternalPlayerFromSonosPlayer(sonos.Player{Id: "PID", WebsocketUrl: "wss://1.2.3.4:1443/websocket/api"}, "HHID", "GID")
+
+	if player.UpdateAddress("wss://1.2.3.4:1443/websocket/api") {
+		t.Errorf("same address reported as a move")
+	}
+
+	if !player.UpdateAddress("wss://1.2.3.5:1443/websocket/api") {
+		t.Errorf("new address not reported as a move")
+	}
+
+	if url := player.CreateFullRESTUrl("/blah"); url != "https://1.2.3.5:1443/api/v1/households/local/blah" {
+		t.Errorf("wrong REST URL after move: %s", url)
+	}
+}
+
+func TestOnMessageRouting(t *testing.T) {
+	cheese := newCheesyTestStuff(t)
+
+	// CmdId that matches a command goes to the command callback
+	cheese.SendCommand("groupVolume", "getVolume")
+	if response := cheese.GetResponse(); response.Headers.Command != "getVolume-resp" {
+		t.Errorf("wrong response: %v", response.Headers)
+	}
+
+	// CmdId that doesn't match (say the response showed up twice) is dropped
+	cheese.InjectEvent(sonos.WebsocketResponse{
+		Headers: sonos.ResponseHeaders{
+			CommonHeaders: sonos.CommonHeaders{Namespace: "groupVolume", CmdId: "1234"},
+			Response:      "getVolume",
+			Success:       true,
+		},
+	})
+
+	if len(cheese.responseChannel) != 0 || cheese.GetEventCount() != 0 {
+		t.Errorf("unmatched response was delivered")
+	}
+
+	// No CmdId is an event
+	cheese.InjectEvent(sonos.WebsocketResponse{
+		Headers: sonos.ResponseHeaders{
+			CommonHeaders: sonos.CommonHeaders{Namespace: "groupVolume"},
+			Type:          "groupVolume",
+		},
+	})
+
+	if event := cheese.GetEvent(); event.Headers.Type != "groupVolume" || cheese.GetEventCount() != 1 {
+		t.Errorf("event not delivered: %v", event.Headers)
+	}
+}
+
+func TestParseFailures(t *testing.T) {
+	cheese := newCheesyTestStuff(t)
+	before := GetParseFailures()
+
+	cheese.websocketClient.callbacks.OnMessage(cheese.websocketClient.userData, []byte(`{"not": "an array"}`))
+	cheese.websocketClient.callbacks.OnMessage(cheese.websocketClient.userData, []byte(`[{}]`))
+
+	if failures := GetParseFailures() - before; failures != 2 {
+		t.Errorf("wrong number of parse failures: %d instead of 2", failures)
+	}
+
+	if cheese.GetEventCount() != 0 {
+		t.Errorf("unparseable message was delivered")
+	}
+}
+
+func TestConcurrentInitWebsocket(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	var lock sync.Mutex
+	dials := 0
+	release := make(chan struct{})
+
+	websocketInitHook = func(url string, userData string, headers http.Header, callbacks WebsocketCallbacks) WebsocketClient {
+		lock.Lock()
+		dials = dials + 1
+		lock.Unlock()
+
+		// Hold the dial open until everyone is trying to connect
+		<-release
+		client := newMockWebsocketClient()
+		client.callbacks = callbacks
+		return client
+	}
+
+	player := newDefaultPlayer()
+	handler := newMockEventHandler()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errors <- player.InitWebsocketConnection(http.Header{}, handler)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		if err != nil {
+			t.Errorf("init failed: %s", err.Error())
+		}
+	}
+
+	if dials != 1 {
+		t.Errorf("dialed %d times instead of once", dials)
+	}
+}
+
+func TestWebsocketStatus(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	ws := newMockWebsocketClient()
+	player := newDefaultPlayer()
+
+	exported := func() ExportedPlayer {
+		body, err := json.Marshal(player)
+		exported := ExportedPlayer{}
+		if err != nil || json.Unmarshal(body, &exported) != nil {
+			t.Fatalf("unable to export player: %s", string(body))
+		}
+		return exported
+	}
+
+	if status := exported(); status.Id != "PID" || status.Connected || status.LastConnect != nil || status.LastDisconnect != nil {
+		t.Errorf("bogus status before connecting: %+v", status)
+	}
+
+	player.InitWebsocketConnection(http.Header{}, newMockEventHandler())
+	if status := exported(); !status.Connected || status.LastConnect == nil || status.LastDisconnect != nil {
+		t.Errorf("bogus status after connecting: %+v", status)
+	}
+
+	// An error means it is on the way down, even though it hasn't closed yet
+	ws.Error(fmt.Errorf("blip"))
+	if player.IsWebsocketConnected() || !player.HasWebsocket() {
+		t.Errorf("error did not mark the player disconnected")
+	}
+
+	ws.Close()
+	if status := exported(); status.Connected || status.LastDisconnect == nil {
+		t.Errorf("bogus status after closing: %+v", status)
+	}
+}
+
+func TestCloseReportedAsError(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	ws := newMockWebsocketClient()
+	player := newDefaultPlayer()
+	handler := newMockEventHandler()
+
+	// Closes we asked for are not errors
+	player.InitWebsocketConnection(http.Header{}, handler)
+	ws.callbacks.OnClose(ws.userData, CloseReason{Local: true})
+	if handler.err != nil {
+		t.Errorf("local close reported as an error: %v", handler.err)
+	}
+
+	// The player hanging up is
+	player.InitWebsocketConnection(http.Header{}, handler)
+	ws.callbacks.OnClose(ws.userData, CloseReason{Code: 1001, Text: "rebooting"})
+	if reason, ok := handler.err.(CloseReason); !ok || !reason.IsNormal() {
+		t.Errorf("player close not reported: %v", handler.err)
+	}
+
+	// But not twice if there was already an error
+	handler.err = nil
+	player.InitWebsocketConnection(http.Header{}, handler)
+	ws.Error(fmt.Errorf("blip"))
+	ws.callbacks.OnClose(ws.userData, CloseReason{Err: fmt.Errorf("blip")})
+	if handler.err == nil || handler.err.Error() != "blip" {
+		t.Errorf("error reported twice: %v", handler.err)
+	}
+}
+
+func TestPlayerReconnect(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	player := newDefaultPlayer()
+	if err := player.Reconnect(); err == nil {
+		t.Errorf("reconnected a player that never connected")
+	}
+
+	// Same headers and handler as last time
+	var sentHeaders http.Header
+	ws := newMockWebsocketClient()
+	websocketInitHook = func(url string, userData string, headers http.Header, callbacks WebsocketCallbacks) WebsocketClient {
+		sentHeaders = headers
+		ws.closed = false
+		ws.callbacks = callbacks
+		return ws
+	}
+
+	handler := newMockEventHandler()
+	player.InitWebsocketConnection(http.Header{"X-Sonos-Api-Key": []string{"KEY"}}, handler)
+	ws.Close()
+
+	sentHeaders = nil
+	if err := player.Reconnect(); err != nil || !player.HasWebsocket() || sentHeaders.Get("X-Sonos-Api-Key") != "KEY" {
+		t.Fatalf("reconnect failed: %v, %v", err, sentHeaders)
+	}
+
+	ws.Error(fmt.Errorf("blip"))
+	if handler.err == nil {
+		t.Errorf("reconnected websocket is not hooked up to the handler")
+	}
+}
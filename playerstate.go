@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+//
+// Per-player state, which is the latest volume, playback state, and track for a player rolled up into
+// one topic.  Simple displays can subscribe to {base}/player/{playerId}/state and be done with it.
+//
+// Volume comes from playerVolume events, so you need to subscribe to playerVolume on players to get it.
+// Everything else comes from group events and is copied to every player in the group.
+//
+
+type PlayerState struct {
+	Volume        *int   `json:"volume,omitempty"`
+	Muted         *bool  `json:"muted,omitempty"`
+	PlaybackState string `json:"playbackState,omitempty"`
+	Artist        string `json:"artist,omitempty"`
+	Album         string `json:"album,omitempty"`
+	Track         string `json:"track,omitempty"`
+	ImageUrl      string `json:"imageUrl,omitempty"`
+}
+
+// updatePlayerStates folds an event into the state of the players it applies to, and publishes the
+// state of any player that changed.  The message must not have been simplified yet.
+func (app *App) updatePlayerStates(group Group, msg *SonosResponseWithId) {
+	var update func(state *PlayerState)
+	players := []Player{}
+
+	switch msg.Headers.Type {
+	case "playerVolume":
+		volume := struct {
+			Volume int  `json:"volume"`
+			Muted  bool `json:"muted"`
+		}{}
+		if err := json.Unmarshal(msg.BodyJSON, &volume); err != nil {
+			return
+		}
+
+		update = func(state *PlayerState) {
+			state.Volume = &volume.Volume
+			state.Muted = &volume.Muted
+		}
+
+		if player, ok := group.Players[msg.playerId]; ok {
+			players = append(players, player)
+		}
+
+	case "playbackStatus":
+		playback := sonos.PlaybackState{}
+		if err := json.Unmarshal(msg.BodyJSON, &playback); err != nil {
+			return
+		}
+
+		update = func(state *PlayerState) {
+			state.PlaybackState = simplePlaybackState(playback.PlaybackState)
+		}
+
+		for _, player := range group.Players {
+			players = append(players, player)
+		}
+
+	case "extendedPlaybackStatus":
+		// Let the simplifier do the heavy lifting
+		body, err := simplifyPlaybackExtended(group.Coordinator, msg.BodyJSON)
+		status := SimpleExtendedPlaybackStatus{}
+		if err != nil || json.Unmarshal(body, &status) != nil {
+			return
+		}
+
+		update = func(state *PlayerState) {
+			state.PlaybackState = status.PlaybackState
+			state.Artist = status.Artist
+			state.Album = status.Album
+			state.Track = status.Track
+			state.ImageUrl = status.ImageUrl
+		}
+
+		for _, player := range group.Players {
+			players = append(players, player)
+		}
+
+	default:
+		return
+	}
+
+	for _, player := range players {
+		state, ok := app.playerStates[player.GetId()]
+		if !ok {
+			state = &PlayerState{}
+			app.playerStates[player.GetId()] = state
+		}
+
+		update(state)
+		app.publishPlayerState(player.GetId(), state)
+	}
+}
+
+// publishPlayerState publishes the state of a player if it changed since we last published it
+func (app *App) publishPlayerState(id string, state *PlayerState) {
+	body, err := marshalWithNoHtmlEscape(state)
+	if err != nil {
+		log.Errorf("app: unable to marshal state for %s: %s", id, err.Error())
+		return
+	}
+
+	if last, ok := app.playerStateBodies[id]; ok && bytes.Equal(last, body) {
+		return
+	}
+	app.playerStateBodies[id] = body
+
+	if app.mqttClient != nil {
+		app.PublishEventToTopic(app.topicFor("player", id, "", "state"), body)
+	}
+}
+
+// PlaybackTransition is published to {base}/group/{coordinatorId}/playbackTransition when the playback
+// state of a group changes
+type PlaybackTransition struct {
+	GroupId string `json:"groupId"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// checkPlaybackTransition publishes a transition if the playback state of the group changed.  The first
+// state we see for a group is not a transition.  The message must not have been simplified yet.
+func (app *App) checkPlaybackTransition(group Group, msg *SonosResponseWithId) {
+	var playbackState string
+
+	switch msg.Headers.Type {
+	case "playbackStatus":
+		playback := sonos.PlaybackState{}
+		if err := json.Unmarshal(msg.BodyJSON, &playback); err != nil {
+			return
+		}
+		playbackState = playback.PlaybackState
+
+	case "extendedPlaybackStatus":
+		status := sonos.ExtendedPlaybackStatus{}
+		if err := json.Unmarshal(msg.BodyJSON, &status); err != nil {
+			return
+		}
+		playbackState = status.PlaybackState.PlaybackState
+
+	default:
+		return
+	}
+
+	if playbackState == "" {
+		return
+	}
+
+	id := group.Coordinator.GetId()
+	to := simplePlaybackState(playbackState)
+	from, ok := app.groupPlaybackStates[id]
+	app.groupPlaybackStates[id] = to
+
+	if !ok || from == to || app.mqttClient == nil {
+		return
+	}
+
+	body, err := json.Marshal(PlaybackTransition{GroupId: group.Id, From: from, To: to})
+	if err != nil {
+		return
+	}
+
+	log.Debugf("app: %s: %s -> %s", id, from, to)
+	app.publishTransient(app.topicFor("group", id, "", "playbackTransition"), body)
+}
@@ -9,10 +9,11 @@ import (
 )
 
 // simplifySonosType converts between the possibly complex type returned by Sonos to a much
-// simpler type suitable for a dumb device.
-func simplifySonosType(msg *SonosResponseWithId) bool {
+// simpler type suitable for a dumb device.  The player is the one that sent the message, and is
+// used to fill in anything the message leaves out (like the host for relative URLs).
+func simplifySonosType(msg *SonosResponseWithId, player Player) bool {
 	if f, ok := simplfiers[msg.Headers.Type]; ok {
-		if body, err := f(msg.WebsocketResponse.BodyJSON); err == nil {
+		if body, err := f(player, msg.WebsocketResponse.BodyJSON); err == nil {
 			msg.Headers.Type = msg.Headers.Type + "Simple"
 			msg.BodyJSON = body
 			return true
@@ -21,11 +22,21 @@ func simplifySonosType(msg *SonosResponseWithId) bool {
 	return false
 }
 
-var simplfiers = map[string]func([]byte) ([]byte, error){
+var simplfiers = map[string]func(Player, []byte) ([]byte, error){
 	"extendedPlaybackStatus": simplifyPlaybackExtended,
 	"groups":                 simplifyGroups,
+	"sessionStatus":          simplifySessionStatus,
+	"audioClipStatus":        simplifyAudioClipStatus,
+	"homeTheaterOptions":     simplifyHomeTheaterOptions,
+	"groupVolume":            simplifyVolume,
+	"playerVolume":           simplifyVolume,
+	"playbackStatus":         simplifyPlaybackStatus,
 }
 
+// playbackStateNames maps Sonos playback states to whatever the user wants to see instead.  States
+// that are not in the map are passed through as is.  Set from the config file.
+var playbackStateNames = map[string]string{}
+
 type SimpleExtendedPlaybackStatus struct {
 	PlaybackState string `json:"playbackState"`
 	Artist        string `json:"artist,omitempty"`
@@ -35,23 +46,32 @@ type SimpleExtendedPlaybackStatus struct {
 	ImageUrl      string `json:"imageUrl,omitempty"`
 }
 
-func simplifyPlaybackExtended(body []byte) ([]byte, error) {
+// simplePlaybackState maps a Sonos playback state to the name we publish
+func simplePlaybackState(playbackState string) string {
+	// Treat buffering like playing for now to cut down on events
+	if playbackState == "PLAYBACK_STATE_BUFFERING" {
+		playbackState = "PLAYBACK_STATE_PLAYING"
+	}
+
+	if name, ok := playbackStateNames[playbackState]; ok {
+		playbackState = name
+	}
+
+	return playbackState
+}
+
+func simplifyPlaybackExtended(player Player, body []byte) ([]byte, error) {
 
 	sonosMsg := sonos.ExtendedPlaybackStatus{}
 	if err := json.Unmarshal(body, &sonosMsg); err != nil {
 		return nil, err
 	}
 
-	// Treat buffering like playing for now to cut down on events
-	playbackState := sonosMsg.PlaybackState.PlaybackState
-	if playbackState == "PLAYBACK_STATE_BUFFERING" {
-		playbackState = "PLAYBACK_STATE_PLAYING"
-	}
+	playbackState := simplePlaybackState(sonosMsg.PlaybackState.PlaybackState)
 
-	// Convert, double decoding imageUrl to work around a Sonos encoding bug
+	// Convert, decoding imageUrl as needed to work around a Sonos encoding bug
 	track := &sonosMsg.Metadata.CurrentItem.Track
-	imageUrl, _ := url.QueryUnescape(track.ImageUrl)
-	imageUrl, _ = url.QueryUnescape(imageUrl)
+	imageUrl := resolveImageUrl(player, decodeImageUrl(track.ImageUrl))
 
 	simpleMsg := SimpleExtendedPlaybackStatus{
 		PlaybackState: playbackState,
@@ -65,17 +85,184 @@ func simplifyPlaybackExtended(body []byte) ([]byte, error) {
 	return marshalWithNoHtmlEscape(simpleMsg)
 }
 
+// decodeImageUrl undoes the Sonos encoding bug, where some services send an imageUrl that has been encoded
+// once or even twice.  We always decode once.  We only decode again if that didn't get us an absolute URL
+// (the scheme is still encoded, say) and the second decode does, so an escape that was meant to be there
+// (%2520 is a %20) survives.  Path unescaping leaves + alone, which matters for the services that send
+// proper URLs.
+func decodeImageUrl(imageUrl string) string {
+	decoded, err := url.PathUnescape(imageUrl)
+	if err != nil {
+		return imageUrl
+	}
+
+	if isAbsoluteUrl(decoded) {
+		return decoded
+	}
+
+	if twice, err := url.PathUnescape(decoded); err == nil && isAbsoluteUrl(twice) {
+		return twice
+	}
+
+	return decoded
+}
+
+// isAbsoluteUrl returns true for URLs with a scheme and a host
+func isAbsoluteUrl(rawUrl string) bool {
+	parsed, err := url.Parse(rawUrl)
+	return err == nil && parsed.IsAbs() && parsed.Host != ""
+}
+
+// resolveImageUrl turns a relative imageUrl into an absolute one using the player's address so
+// that dashboards can use it directly.  Absolute URLs are returned as is.
+func resolveImageUrl(player Player, imageUrl string) string {
+	if len(imageUrl) == 0 || player == nil {
+		return imageUrl
+	}
+
+	ref, err := url.Parse(imageUrl)
+	if err != nil || ref.IsAbs() {
+		return imageUrl
+	}
+
+	base, err := url.Parse(player.CreateFullRESTUrl(""))
+	if err != nil || !base.IsAbs() {
+		return imageUrl
+	}
+
+	return base.ResolveReference(ref).String()
+}
+
+type SimpleSessionStatus struct {
+	Active     bool   `json:"active"`
+	State      string `json:"state"`
+	SessionId  string `json:"sessionId,omitempty"`
+	AppId      string `json:"appId,omitempty"`
+	AppContext string `json:"appContext,omitempty"`
+}
+
+func simplifySessionStatus(player Player, body []byte) ([]byte, error) {
+
+	sonosMsg := sonos.SessionStatus{}
+	if err := json.Unmarshal(body, &sonosMsg); err != nil {
+		return nil, err
+	}
+
+	// Anything other than connected means nobody owns the group any more
+	simpleMsg := SimpleSessionStatus{
+		Active:     sonosMsg.SessionState == "SESSION_STATE_CONNECTED",
+		State:      sonosMsg.SessionState,
+		SessionId:  sonosMsg.SessionId,
+		AppId:      sonosMsg.AppId,
+		AppContext: sonosMsg.AppContext,
+	}
+
+	return json.Marshal(simpleMsg)
+}
+
+type SimpleAudioClip struct {
+	Id     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+}
+
+func simplifyAudioClipStatus(player Player, body []byte) ([]byte, error) {
+
+	sonosMsg := sonos.AudioClipStatus{}
+	if err := json.Unmarshal(body, &sonosMsg); err != nil {
+		return nil, err
+	}
+
+	simpleMsg := make([]SimpleAudioClip, 0, len(sonosMsg.AudioClips))
+	for _, clip := range sonosMsg.AudioClips {
+		simpleMsg = append(simpleMsg, SimpleAudioClip{
+			Id:     clip.Id,
+			Name:   clip.Name,
+			Status: clip.Status,
+		})
+	}
+
+	return json.Marshal(simpleMsg)
+}
+
+type SimpleHomeTheaterOptions struct {
+	NightMode     bool `json:"nightMode"`
+	EnhanceDialog bool `json:"enhanceDialog"`
+}
+
+func simplifyHomeTheaterOptions(player Player, body []byte) ([]byte, error) {
+
+	sonosMsg := sonos.HomeTheaterOptions{}
+	if err := json.Unmarshal(body, &sonosMsg); err != nil {
+		return nil, err
+	}
+
+	simpleMsg := SimpleHomeTheaterOptions{
+		NightMode:     sonosMsg.NightMode != nil && *sonosMsg.NightMode,
+		EnhanceDialog: sonosMsg.EnhanceDialog != nil && *sonosMsg.EnhanceDialog,
+	}
+
+	return json.Marshal(simpleMsg)
+}
+
+// SimpleVolume is used for both group and player volume, since Sonos sends the same thing for both
+type SimpleVolume struct {
+	Volume int  `json:"volume"`
+	Muted  bool `json:"muted"`
+	Fixed  bool `json:"fixed"`
+}
+
+func simplifyVolume(player Player, body []byte) ([]byte, error) {
+
+	sonosMsg := sonos.Volume{}
+	if err := json.Unmarshal(body, &sonosMsg); err != nil {
+		return nil, err
+	}
+
+	simpleMsg := SimpleVolume{
+		Volume: sonosMsg.Volume,
+		Muted:  sonosMsg.Muted,
+		Fixed:  sonosMsg.Fixed,
+	}
+
+	return json.Marshal(simpleMsg)
+}
+
+type SimplePlaybackStatus struct {
+	PlaybackState  string `json:"playbackState"`
+	PositionMillis int64  `json:"positionMillis"`
+	IsDucking      bool   `json:"isDucking"`
+}
+
+func simplifyPlaybackStatus(player Player, body []byte) ([]byte, error) {
+
+	sonosMsg := sonos.PlaybackState{}
+	if err := json.Unmarshal(body, &sonosMsg); err != nil {
+		return nil, err
+	}
+
+	simpleMsg := SimplePlaybackStatus{
+		PlaybackState:  simplePlaybackState(sonosMsg.PlaybackState),
+		PositionMillis: sonosMsg.PositionMillis,
+		IsDucking:      sonosMsg.IsDucking,
+	}
+
+	return json.Marshal(simpleMsg)
+}
+
 type SimplePlayer struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
 }
 
 type SimpleGroup struct {
-	Id      string         `json:"id"`
-	Players []SimplePlayer `json:"players"`
+	Id          string         `json:"id"`
+	Name        string         `json:"name"`
+	PlayerCount int            `json:"playerCount"`
+	Players     []SimplePlayer `json:"players"`
 }
 
-func simplifyGroups(body []byte) ([]byte, error) {
+func simplifyGroups(player Player, body []byte) ([]byte, error) {
 
 	// Parse the message
 	sonosMsg := sonos.GroupsResponse{}
@@ -99,19 +286,26 @@ func simplifyGroups(body []byte) ([]byte, error) {
 
 		group := SimpleGroup{
 			Id:      g.CoordinatorId,
+			Name:    g.Name,
 			Players: make([]SimplePlayer, 0, 64),
 		}
 
+		// Coordinator first.  It is also in PlayerIds, so skip it there.
 		if groupCoordinator, ok := allPlayers[g.CoordinatorId]; ok {
 			group.Players = append(group.Players, groupCoordinator)
 		}
 
 		for _, p := range g.PlayerIds {
+			if p == g.CoordinatorId {
+				continue
+			}
 			if player, ok := allPlayers[p]; ok {
 				group.Players = append(group.Players, player)
 			}
 		}
 
+		group.PlayerCount = len(group.Players)
+
 		allGroups = append(allGroups, group)
 	}
 
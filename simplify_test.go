@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+func TestResolveImageUrl(t *testing.T) {
+	player := NewInternalPlayerFromSonosPlayer(sonos.Player{
+		Id:           "PID",
+		Name:         "NAME",
+		WebsocketUrl: "wss://1.2.3.4:1443/websocket/api",
+	}, "HHID", "GID")
+
+	tests := map[string]string{
+		"":                              "",
+		"/getaa?s=1&u=x-file":           "https://1.2.3.4:1443/getaa?s=1&u=x-file",
+		"http://art.example.com/a.jpg":  "http://art.example.com/a.jpg",
+		"https://art.example.com/a.jpg": "https://art.example.com/a.jpg",
+	}
+
+	for in, expected := range tests {
+		if out := resolveImageUrl(player, in); out != expected {
+			t.Errorf("wrong URL for %s: %s instead of %s", in, out, expected)
+		}
+	}
+}
+
+func TestSimplifyGroups(t *testing.T) {
+	body, _ := json.Marshal(newTestGroupsResponse())
+
+	simple, err := simplifyGroups(nil, body)
+	if err != nil {
+		t.Fatalf("simplifyGroups failed: %s", err.Error())
+	}
+
+	groups := []SimpleGroup{}
+	if err := json.Unmarshal(simple, &groups); err != nil {
+		t.Fatalf("unable to parse simple groups: %s", err.Error())
+	}
+
+	for _, group := range groups {
+		if group.Id == "P1" {
+			if group.Name != "Kitchen + Den" || group.PlayerCount != 2 || len(group.Players) != 2 {
+				t.Errorf("bogus group: %v", group)
+			}
+			if group.Players[0].Id != "P1" {
+				t.Errorf("coordinator is not first: %v", group)
+			}
+		}
+	}
+}
+
+func TestSimplifyAudioClipStatus(t *testing.T) {
+	body := []byte(`{"_objectType":"audioClipStatus","audioClips":[{"_objectType":"audioClip","id":"C1","name":"Doorbell","appId":"com.example","status":"DONE"}]}`)
+
+	simple, err := simplifyAudioClipStatus(nil, body)
+	if err != nil {
+		t.Fatalf("simplifyAudioClipStatus failed: %s", err.Error())
+	}
+
+	if string(simple) != `[{"id":"C1","name":"Doorbell","status":"DONE"}]` {
+		t.Errorf("bogus audio clip status: %s", string(simple))
+	}
+}
+
+func TestSimplifyHomeTheaterOptions(t *testing.T) {
+	simple, err := simplifyHomeTheaterOptions(nil, []byte(`{"_objectType":"homeTheaterOptions","nightMode":true}`))
+	if err != nil {
+		t.Fatalf("simplifyHomeTheaterOptions failed: %s", err.Error())
+	}
+
+	if string(simple) != `{"nightMode":true,"enhanceDialog":false}` {
+		t.Errorf("bogus home theater options: %s", string(simple))
+	}
+}
+
+func TestSimplifyVolume(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"group", `{"_objectType":"groupVolume","volume":32,"muted":false,"fixed":false}`, `{"volume":32,"muted":false,"fixed":false}`},
+		{"player", `{"_objectType":"playerVolume","volume":18,"muted":true,"fixed":false}`, `{"volume":18,"muted":true,"fixed":false}`},
+		{"fixed line out", `{"_objectType":"groupVolume","volume":100,"muted":false,"fixed":true}`, `{"volume":100,"muted":false,"fixed":true}`},
+		{"missing fields", `{"_objectType":"playerVolume","volume":5}`, `{"volume":5,"muted":false,"fixed":false}`},
+	}
+
+	for _, test := range tests {
+		simple, err := simplifyVolume(nil, []byte(test.body))
+		if err != nil || string(simple) != test.expected {
+			t.Errorf("%s: bogus volume: %s, %v", test.name, string(simple), err)
+		}
+	}
+
+	if _, err := simplifyVolume(nil, []byte(`{"volume":"loud"}`)); err == nil {
+		t.Errorf("bogus volume was simplified")
+	}
+}
+
+func TestSimplifyPlaybackStatus(t *testing.T) {
+	defer func(names map[string]string) { playbackStateNames = names }(playbackStateNames)
+	playbackStateNames = map[string]string{"PLAYBACK_STATE_PLAYING": "playing"}
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			"playing",
+			`{"_objectType":"playbackStatus","playbackState":"PLAYBACK_STATE_PLAYING","isDucking":false,"positionMillis":83500,"previousPositionMillis":82500,` +
+				`"playModes":{"repeat":false,"repeatOne":false,"crossfade":false,"shuffle":false},` +
+				`"availablePlaybackActions":{"canSkip":true,"canSkipBack":true,"canSeek":true,"canPause":true,"canStop":true}}`,
+			`{"playbackState":"playing","positionMillis":83500,"isDucking":false}`,
+		},
+		{
+			"ducking while buffering",
+			`{"_objectType":"playbackStatus","playbackState":"PLAYBACK_STATE_BUFFERING","isDucking":true,"positionMillis":0}`,
+			`{"playbackState":"playing","positionMillis":0,"isDucking":true}`,
+		},
+		{
+			"missing fields",
+			`{"_objectType":"playbackStatus","playbackState":"PLAYBACK_STATE_IDLE"}`,
+			`{"playbackState":"PLAYBACK_STATE_IDLE","positionMillis":0,"isDucking":false}`,
+		},
+	}
+
+	for _, test := range tests {
+		simple, err := simplifyPlaybackStatus(nil, []byte(test.body))
+		if err != nil || string(simple) != test.expected {
+			t.Errorf("%s: bogus playback status: %s, %v", test.name, string(simple), err)
+		}
+	}
+}
+
+func TestDecodeImageUrl(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"normal", "https://art.example.com/a.jpg?size=large", "https://art.example.com/a.jpg?size=large"},
+		{"normal with plus", "https://art.example.com/a+b.jpg", "https://art.example.com/a+b.jpg"},
+		{"encoded percent", "https://art.example.com/a%2520b.jpg", "https://art.example.com/a%20b.jpg"},
+		{"relative", "/getaa?s=1&u=x-sonos-spotify%3aspotify%253atrack", "/getaa?s=1&u=x-sonos-spotify:spotify%3atrack"},
+		{"bad escape", "https://art.example.com/a%zzb.jpg", "https://art.example.com/a%zzb.jpg"},
+		{"encoded once", "https%3A%2F%2Fart.example.com%2Fa.jpg", "https://art.example.com/a.jpg"},
+		{"encoded twice", "https%253A%252F%252Fart.example.com%252Fa.jpg%253Fsize%253Dlarge", "https://art.example.com/a.jpg?size=large"},
+		{"garbage", "not a url", "not a url"},
+	}
+
+	for _, test := range tests {
+		if out := decodeImageUrl(test.in); out != test.expected {
+			t.Errorf("%s: %s instead of %s", test.name, out, test.expected)
+		}
+	}
+}
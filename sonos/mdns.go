@@ -72,12 +72,13 @@ func (resp *mDNSResponse) GetHouseholdId() (string, error) {
 	return "", fmt.Errorf("mDNS: %s", "No hhid found")
 }
 
-// GetInfoUrl returns the full /info URL if it exists
+// GetInfoUrl returns the full /info URL if it exists.  It is whatever api version the player advertised, so
+// callers need to convert it to the one they want.
 //
 // Required for the interface
 func (resp *mDNSResponse) GetInfoUrl() (string, error) {
 	if data, ok := resp.records["info"]; ok {
-		return ConvertToApiVersion1(fmt.Sprintf("https://%s:%d%s", resp.IP, resp.Port, data)), nil
+		return fmt.Sprintf("https://%s:%d%s", resp.IP, resp.Port, data), nil
 	}
 	return "", fmt.Errorf("%s", "mDNS: No info found")
 }
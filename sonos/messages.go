@@ -3,13 +3,19 @@ package sonos
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
+	"regexp"
 )
 
-// ConvertToApiVersion1 replaces v2 in api versions with v1.  At least for now.  I'll eventually have to support v2 when/if
-// Sonos ever ships any changes.
-func ConvertToApiVersion1(url string) string {
-	return strings.Replace(url, "/v2/", "/v1/", 1)
+var apiVersionRegexp = regexp.MustCompile(`/v[0-9]+/`)
+
+// ConvertToApiVersion replaces the api version in a URL the players gave us (/v1/, /v2/, ...) with the one
+// we want to talk, which is v1 unless the config says otherwise.  Only the first one is touched, since that
+// is the api bit and anything after it is not ours to mess with.
+func ConvertToApiVersion(url string, version string) string {
+	if loc := apiVersionRegexp.FindStringIndex(url); loc != nil {
+		return url[:loc[0]] + "/" + version + "/" + url[loc[1]:]
+	}
+	return url
 }
 
 //
@@ -21,6 +27,8 @@ func ConvertToApiVersion1(url string) string {
 var playerTargetedCommands = map[string]bool{
 	"settings":     true,
 	"playerVolume": true,
+	"audioClip":    true,
+	"homeTheater":  true,
 }
 
 func IsPlayerTargetedCommand(namespace string) bool {
@@ -65,8 +73,19 @@ type Player struct {
 	Capabilities []string `json:"capabilities"`
 }
 
+// PlaybackState is evented as playbackStatus when subscribing to playback, and is also the playback part
+// of ExtendedPlaybackStatus.  Only the stuff I care about.
 type PlaybackState struct {
-	PlaybackState string `json:"playbackState"`
+	PlaybackState  string `json:"playbackState"`
+	PositionMillis int64  `json:"positionMillis"`
+	IsDucking      bool   `json:"isDucking"`
+}
+
+// Volume is evented as groupVolume and playerVolume when subscribing to the namespaces of the same name
+type Volume struct {
+	Volume int  `json:"volume"`
+	Muted  bool `json:"muted"`
+	Fixed  bool `json:"fixed"`
 }
 
 // ExtendedPlaybackStatus, which is evented when subscribing to playbackExtended.  This is
@@ -93,6 +112,56 @@ type ExtendedPlaybackStatus struct {
 	} `json:"Metadata"`
 }
 
+// SessionStatus, which is evented when subscribing to playbackSession.  It tells us whether
+// a cloud session (Spotify Connect, an app using playbackSession, etc) currently owns the group.
+type SessionStatus struct {
+	SessionState   string `json:"sessionState"`
+	SessionId      string `json:"sessionId"`
+	SessionCreated bool   `json:"sessionCreated"`
+	AppId          string `json:"appId"`
+	AppContext     string `json:"appContext"`
+	CustomData     string `json:"customData"`
+}
+
+// AudioClipStatus, which is evented when subscribing to audioClip on a player.  Only players with
+// the AUDIO_CLIP capability send these.
+type AudioClipStatus struct {
+	AudioClips []AudioClip `json:"audioClips"`
+}
+
+type AudioClip struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	AppId     string `json:"appId"`
+	Status    string `json:"status"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// LoadAudioClip is the body of audioClip/loadAudioClip.  Volume of 0 leaves it up to the player.
+type LoadAudioClip struct {
+	Name      string `json:"name"`
+	AppId     string `json:"appId"`
+	StreamUrl string `json:"streamUrl,omitempty"`
+	ClipType  string `json:"clipType,omitempty"`
+	Volume    int    `json:"volume,omitempty"`
+}
+
+// PlayerSettings is the body of settings/setPlayerSettings.  Everything is optional so callers
+// can change one setting without touching the rest.
+type PlayerSettings struct {
+	Bass     *int  `json:"bass,omitempty"`
+	Treble   *int  `json:"treble,omitempty"`
+	Loudness *bool `json:"loudness,omitempty"`
+	Balance  *int  `json:"balance,omitempty"`
+}
+
+// HomeTheaterOptions is evented as homeTheaterOptions when subscribing to homeTheater on a player, and
+// is also the body of homeTheater/setOptions.  Everything is optional for the same reason as above.
+type HomeTheaterOptions struct {
+	NightMode     *bool `json:"nightMode,omitempty"`
+	EnhanceDialog *bool `json:"enhanceDialog,omitempty"`
+}
+
 // CommonHeaders are headers that are common to requests and responses.  This saves
 // me some typing.
 type CommonHeaders struct {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Topic templates.  Every topic for a player, group or household event is built from topictemplate in
+// the config, so folks can make the topics look like whatever they already have.  The default gives the
+// topics we have always used:
+//
+//   {base}/player/{playerId}/{type}
+//   {base}/group/{coordinatorId}/{type}
+//   {base}/{type}
+//
+// Everything goes through topicFor, and RemoveStaleTopics uses topicPrefix to find what to clear, so the
+// two can't disagree about where things live.  Templates that use {{.Name}} move a group's topics every
+// time it is regrouped, so the old ones are cleared when the groups change.  Topics that are about the
+// bridge itself ({base}/players, {base}/format and friends) are not templated.
+//
+
+const defaultTopicTemplate = "{{.Base}}/{{if .Scope}}{{.Scope}}/{{.Id}}/{{end}}{{.Type}}"
+
+// TopicVars is what a topic template has to work with.  Scope is player, group, or empty for household
+// events.  Type includes the namespace if namespaceinpath is set, and Namespace is there for templates
+// that want to put it somewhere else.
+type TopicVars struct {
+	Base      string
+	Scope     string
+	Id        string
+	Name      string
+	Namespace string
+	Type      string
+}
+
+// Marks where the type goes when we only want the part of the topic before it
+const topicSentinel = "\x00"
+
+// newTopicTemplate parses a topic template, or the default if it is empty.  It also makes sure we can find
+// every topic for a player or group by prefix, which means the player or group has to come before the
+// namespace and type, and that every topic is under the base topic.
+func newTopicTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultTopicTemplate
+	}
+
+	tmpl, err := template.New("topic").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := TopicVars{Base: "<base>", Scope: "player", Id: "<id>", Name: "<name>", Namespace: topicSentinel, Type: topicSentinel}
+	topic, err := executeTopicTemplate(tmpl, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.SplitN(topic, topicSentinel, 2)
+	if len(prefix) != 2 || !(strings.Contains(prefix[0], "<id>") || strings.Contains(prefix[0], "<name>")) {
+		return nil, fmt.Errorf("topic template must use {{.Type}}, with {{.Id}} or {{.Name}} before it")
+	}
+
+	// Everything has to live under the base topic, or the API can't subscribe to it and we can't clear it
+	for _, scope := range []string{"player", "group", ""} {
+		vars.Scope = scope
+		if topic, err = executeTopicTemplate(tmpl, vars); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(topic, "<base>/") {
+			return nil, fmt.Errorf("topic template must start with {{.Base}}/")
+		}
+	}
+
+	return tmpl, nil
+}
+
+// topicTemplateOrDefault is newTopicTemplate for NewApp, which has nobody to hand an error to.  The config
+// has been checked by then, so the default is just in case.
+func topicTemplateOrDefault(text string) *template.Template {
+	tmpl, err := newTopicTemplate(text)
+	if err != nil {
+		log.Errorf("app: bad topic template, using the default: %s", err.Error())
+		tmpl, _ = newTopicTemplate("")
+	}
+	return tmpl
+}
+
+func executeTopicTemplate(tmpl *template.Template, vars TopicVars) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// topicName returns the name of a player or group for templates that use it.  MQTT wildcards and slashes
+// can't be in a name, so they are swapped out.
+func topicName(groups map[string]Group, scope string, id string) string {
+	name := id
+	switch scope {
+	case "player":
+		if group, ok := findGroupForPlayer(groups, id); ok {
+			name = group.Players[id].GetName()
+		}
+	case "group":
+		if group, ok := groups[id]; ok {
+			name = group.Name
+		}
+	}
+
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+// topicFor returns the topic for something about a player, group (by coordinator) or the household.  Main
+// goroutine only.
+func (app *App) topicFor(scope string, id string, namespace string, eventType string) string {
+	return app.topicForGroups(app.groups, scope, id, namespace, eventType)
+}
+
+// topicForGroups is topicFor with names taken from the given groups instead of the current ones
+func (app *App) topicForGroups(groups map[string]Group, scope string, id string, namespace string, eventType string) string {
+	vars := TopicVars{
+		Base:      app.config.MQTT.Topic,
+		Scope:     scope,
+		Id:        id,
+		Name:      topicName(groups, scope, id),
+		Namespace: namespace,
+		Type:      eventType,
+	}
+
+	topic, err := executeTopicTemplate(app.topicTemplate, vars)
+	if err != nil {
+		// The template was checked when we loaded it, so this should never happen
+		log.Errorf("app: topic template failed for %s %s: %s", scope, id, err.Error())
+		return fmt.Sprintf("%s/%s", app.config.MQTT.Topic, eventType)
+	}
+	return topic
+}
+
+// topicPrefix returns what every topic for a player or group starts with
+func (app *App) topicPrefix(scope string, id string) string {
+	return app.topicPrefixForGroups(app.groups, scope, id)
+}
+
+func (app *App) topicPrefixForGroups(groups map[string]Group, scope string, id string) string {
+	topic := app.topicForGroups(groups, scope, id, topicSentinel, topicSentinel)
+	return strings.SplitN(topic, topicSentinel, 2)[0]
+}
+
+// movedTopicPrefixes returns the old prefixes of players and groups that are still around but publish
+// somewhere else with the new groups.  That only happens when the template uses {{.Name}}, since a
+// group's name changes whenever players join or leave it, and players can be renamed.  Prefixes that are
+// still in use (two groups swapping names, say) are left alone.
+func (app *App) movedTopicPrefixes(newGroups map[string]Group) []string {
+	oldPrefixes := map[string]bool{}
+	newPrefixes := map[string]bool{}
+
+	newPlayers := getPlayers(newGroups)
+	for id := range newPlayers {
+		newPrefixes[app.topicPrefixForGroups(newGroups, "player", id)] = true
+	}
+	for id := range newGroups {
+		newPrefixes[app.topicPrefixForGroups(newGroups, "group", id)] = true
+	}
+
+	for id := range getPlayers(app.groups) {
+		if newPlayers[id] {
+			oldPrefixes[app.topicPrefixForGroups(app.groups, "player", id)] = true
+		}
+	}
+	for id := range app.groups {
+		if _, ok := newGroups[id]; ok {
+			oldPrefixes[app.topicPrefixForGroups(app.groups, "group", id)] = true
+		}
+	}
+
+	moved := make([]string, 0, len(oldPrefixes))
+	for prefix := range oldPrefixes {
+		if !newPrefixes[prefix] {
+			moved = append(moved, prefix)
+		}
+	}
+	return moved
+}
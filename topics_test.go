@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+func TestDefaultTopicTemplate(t *testing.T) {
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	// Same topics as before there were templates
+	tests := []struct {
+		topic    string
+		expected string
+	}{
+		{app.topicFor("player", "P2", "playerVolume", "playerVolume"), "sonos/player/P2/playerVolume"},
+		{app.topicFor("group", "P1", "groupVolume", "groupVolume"), "sonos/group/P1/groupVolume"},
+		{app.topicFor("", "", "favorites", "favoritesList"), "sonos/favoritesList"},
+		{app.topicPrefix("player", "P2"), "sonos/player/P2/"},
+		{app.topicPrefix("group", "P1"), "sonos/group/P1/"},
+	}
+
+	for _, test := range tests {
+		if test.topic != test.expected {
+			t.Errorf("%s instead of %s", test.topic, test.expected)
+		}
+	}
+}
+
+func TestCustomTopicTemplate(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.TopicTemplate = "{{.Base}}/{{if .Scope}}{{.Name}}/{{end}}{{.Namespace}}/{{.Type}}"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	msg := SonosResponseWithId{playerId: "P1"}
+	msg.Headers.Namespace = "groupVolume"
+	msg.Headers.Type = "groupVolume"
+	msg.Headers.GroupId = "P1:1"
+	msg.BodyJSON = []byte(`{"volume":10}`)
+	app.PublishEventToAllTopics(app.groups["P1"], &msg)
+
+	// Names can't have wildcards in them
+	topic := "sonos/Kitchen _ Den/groupVolume/groupVolume"
+	if body := client.WaitForTopic(t, topic); string(body) != `{"volume":10}` {
+		t.Errorf("bogus body: %s", string(body))
+	}
+
+	// And clearing finds the same topic
+	app.RemoveStaleTopics([]string{}, []string{"P1"})
+	if body := client.WaitForTopic(t, topic); len(body) != 0 {
+		t.Errorf("%s was not cleared: %s", topic, string(body))
+	}
+}
+
+func TestRegroupClearsMovedTopics(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	config.MQTT.TopicTemplate = "{{.Base}}/{{if .Scope}}{{.Scope}}/{{.Name}}/{{end}}{{.Type}}"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	for _, id := range []string{"P1", "P3"} {
+		app.PublishEventToTopic(app.topicFor("group", id, "groupVolume", "groupVolume"), []byte(`{"volume":10}`))
+	}
+	app.PublishEventToTopic(app.topicFor("player", "P2", "playerVolume", "playerVolume"), []byte(`{"volume":20}`))
+
+	// Den leaves Kitchen and joins Office, which renames both groups
+	response := newTestGroupsResponse()
+	response.Groups[0] = sonos.Group{Id: "P1:2", Name: "Kitchen", CoordinatorId: "P1", PlayerIds: []string{"P1"}}
+	response.Groups[1] = sonos.Group{Id: "P3:2", Name: "Office + Den", CoordinatorId: "P3", PlayerIds: []string{"P3", "P2"}}
+	groups, _ := getGroupMap("HHID", response, 0)
+	app.applyGroupsUpdate(groups)
+
+	for _, topic := range []string{"sonos/group/Kitchen _ Den/groupVolume", "sonos/group/Office/groupVolume"} {
+		if body := client.WaitForTopic(t, topic); len(body) != 0 {
+			t.Errorf("%s was not cleared: %s", topic, string(body))
+		}
+	}
+
+	// The player name didn't change, so its topics stay put
+	if body := client.WaitForTopic(t, "sonos/player/Den/playerVolume"); string(body) != `{"volume":20}` {
+		t.Errorf("player topic was cleared: %s", string(body))
+	}
+}
+
+func TestUngroupClearsGroupTopics(t *testing.T) {
+	client := newMockMQTTClient()
+
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+	app := NewApp(config, client)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	app.PublishEventToTopic(app.topicFor("group", "P3", "groupVolume", "groupVolume"), []byte(`{"volume":10}`))
+
+	// Office joins Kitchen + Den, so there is no P3 group any more
+	response := newTestGroupsResponse()
+	response.Groups = []sonos.Group{{Id: "P1:2", Name: "Kitchen + 2", CoordinatorId: "P1", PlayerIds: []string{"P1", "P2", "P3"}}}
+	groups, _ := getGroupMap("HHID", response, 0)
+	app.applyGroupsUpdate(groups)
+
+	if body := client.WaitForTopic(t, "sonos/group/P3/groupVolume"); len(body) != 0 {
+		t.Errorf("group topic was not cleared: %s", string(body))
+	}
+}
+
+func TestBadTopicTemplates(t *testing.T) {
+	for _, text := range []string{
+		"{{.Base}}/{{.Id}}",
+		"{{.Base}}/{{.Type}}/{{.Id}}",
+		"{{.Base}}/{{.Bogus}}/{{.Type}}",
+		"{{.Base}}/{{.Id}/{{.Type}}",
+		"sonos/{{.Scope}}/{{.Id}}/{{.Type}}",
+		"{{.Scope}}/{{.Id}}/{{.Base}}/{{.Type}}",
+		"{{if .Scope}}{{.Base}}/{{.Scope}}/{{.Id}}/{{end}}{{.Type}}",
+		"{{.Base}}{{.Id}}/{{.Type}}",
+	} {
+		if _, err := newTopicTemplate(text); err == nil {
+			t.Errorf("%s was accepted", text)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/swmerc/sonosmqtt/sonos"
+)
+
+//
+// Text to speech.  We don't do any speech ourselves.  The config has a URL template for some TTS
+// service, and we either hand the resulting URL straight to the player as an audio clip or ask the
+// service for the audio URL first.
+//
+
+// TTSConfig is the section of a config file that describes the TTS service
+type TTSConfig struct {
+	URL     string `yaml:"url" doc:"URL template for the TTS service.  {text} and {voice} are replaced (escaped).  Empty disables /say."`
+	Voice   string `yaml:"voice" doc:"Voice to use when the request does not pick one"`
+	Resolve bool   `yaml:"resolve" doc:"GET the URL and use the response (plain text or {\"url\": ...}) as the audio URL"`
+	Volume  int    `yaml:"volume" doc:"Volume for announcements.  0 uses the player's default for audio clips."`
+}
+
+// SayRequest is the body for Say.  Voice and Volume override the config.
+type SayRequest struct {
+	Text   string `json:"text"`
+	Voice  string `json:"voice,omitempty"`
+	Volume int    `json:"volume,omitempty"`
+}
+
+// How long we give the TTS service to hand us a URL
+const ttsTimeout = 10 * time.Second
+
+// Say turns text into an audio URL via the TTS service and plays it on the player as an audio clip.
+// Returns whatever the player said about the clip.
+func (app *App) Say(id string, body []byte) ([]byte, error) {
+	if len(app.config.TTS.URL) == 0 {
+		return nil, fmt.Errorf("404")
+	}
+
+	request := SayRequest{}
+	if err := json.Unmarshal(body, &request); err != nil || len(strings.TrimSpace(request.Text)) == 0 {
+		return nil, fmt.Errorf("400")
+	}
+
+	if request.Voice == "" {
+		request.Voice = app.config.TTS.Voice
+	}
+	if request.Volume == 0 {
+		request.Volume = app.config.TTS.Volume
+	}
+	if request.Volume < 0 || request.Volume > 100 {
+		return nil, fmt.Errorf("400")
+	}
+
+	streamUrl := ttsUrl(app.config.TTS.URL, request.Text, request.Voice)
+	if app.config.TTS.Resolve {
+		var err error
+		if streamUrl, err = resolveTTSUrl(streamUrl); err != nil {
+			log.Errorf("tts: unable to get audio URL: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	log.Debugf("tts: %s: %s", id, streamUrl)
+
+	clip := sonos.LoadAudioClip{
+		Name:      "sonosmqtt",
+		AppId:     "com.github.swmerc.sonosmqtt",
+		StreamUrl: streamUrl,
+		ClipType:  "CUSTOM",
+		Volume:    request.Volume,
+	}
+	clipJSON, err := json.Marshal(clip)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.PostDataREST(id, "audioClip", "loadAudioClip", clipJSON)
+}
+
+// ttsUrl fills in the template.  Placeholders in the path are path escaped, and those in the query are
+// query escaped, since a + is only a space in the query.
+func ttsUrl(template string, text string, voice string) string {
+	path, query := template, ""
+	if i := strings.Index(template, "?"); i >= 0 {
+		path, query = template[:i], template[i:]
+	}
+
+	return strings.NewReplacer(
+		"{text}", url.PathEscape(text),
+		"{voice}", url.PathEscape(voice),
+	).Replace(path) + strings.NewReplacer(
+		"{text}", url.QueryEscape(text),
+		"{voice}", url.QueryEscape(voice),
+	).Replace(query)
+}
+
+// resolveTTSUrl asks the TTS service for the audio URL.  It can answer with the URL as plain text, or
+// as JSON with a url field.
+func resolveTTSUrl(serviceUrl string) (string, error) {
+	client := &http.Client{Timeout: ttsTimeout}
+
+	response, err := client.Get(serviceUrl)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("code: %d", response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := struct {
+		URL string `json:"url"`
+	}{}
+	audioUrl := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &resolved) == nil && resolved.URL != "" {
+		audioUrl = resolved.URL
+	}
+
+	if parsed, err := url.Parse(audioUrl); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("bogus audio URL: %s", audioUrl)
+	}
+
+	return audioUrl, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTTSUrl(t *testing.T) {
+	got := ttsUrl("https://tts/speak?voice={voice}&text={text}", "hello & bye", "en-US")
+	if got != "https://tts/speak?voice=en-US&text=hello+%26+bye" {
+		t.Errorf("wrong URL: %s", got)
+	}
+
+	got = ttsUrl("https://tts/{voice}/{text}.mp3?speed=1", "hello & bye/now", "en-US")
+	if got != "https://tts/en-US/hello%20&%20bye%2Fnow.mp3?speed=1" {
+		t.Errorf("wrong path URL: %s", got)
+	}
+}
+
+func TestResolveTTSUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("format") {
+		case "json":
+			w.Write([]byte(`{"url": "http://tts/clip.mp3"}`))
+		case "text":
+			w.Write([]byte("http://tts/clip.mp3\n"))
+		default:
+			w.Write([]byte("not a url"))
+		}
+	}))
+	defer server.Close()
+
+	for _, format := range []string{"json", "text"} {
+		if audioUrl, err := resolveTTSUrl(server.URL + "?format=" + format); err != nil || audioUrl != "http://tts/clip.mp3" {
+			t.Errorf("%s: wrong audio URL: %s, %v", format, audioUrl, err)
+		}
+	}
+
+	if _, err := resolveTTSUrl(server.URL); err == nil {
+		t.Errorf("bogus audio URL was accepted")
+	}
+}
+
+func TestSayNotConfigured(t *testing.T) {
+	app := NewApp(Config{}, nil)
+
+	if _, err := app.Say("P1", []byte(`{"text":"hello"}`)); err == nil || err.Error() != "404" {
+		t.Errorf("say without a TTS service did not 404: %v", err)
+	}
+
+	app.config.TTS.URL = "http://tts/{text}"
+	if _, err := app.Say("P1", []byte(`{"text":" "}`)); err == nil || err.Error() != "400" {
+		t.Errorf("say without text did not 400: %v", err)
+	}
+}
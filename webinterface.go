@@ -3,6 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/swmerc/sonosmqtt/sonos"
@@ -16,31 +24,62 @@ import (
 // Simplified version of groups.  The internal version is a map of groups containing maps of players, this
 // is just a coordinatorId and a slice of players in the group.
 type ExportedGroup struct {
-	CoordinatorId string   `json:"id"`
-	Players       []Player `json:"players"`
+	CoordinatorId string                `json:"id"`
+	Name          string                `json:"name"`
+	PlayerCount   int                   `json:"playerCount"`
+	Players       []ExportedGroupMember `json:"players"`
+}
+
+// ExportedGroupMember is a player in an ExportedGroup.  Groups are just who is in them, so this leaves out
+// the websocket status that ExportedPlayer has.  It would change the groups every time a websocket blips.
+type ExportedGroupMember struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 func exportedGroupFromGroup(group Group) ExportedGroup {
 	exported := ExportedGroup{
 		CoordinatorId: group.Coordinator.GetId(),
-		Players:       make([]Player, 0, 64),
+		Name:          group.Name,
+		PlayerCount:   len(group.Players),
+		Players:       make([]ExportedGroupMember, 0, 64),
 	}
 
 	for _, player := range group.Players {
-		exported.Players = append(exported.Players, player)
+		exported.Players = append(exported.Players, ExportedGroupMember{Id: player.GetId(), Name: player.GetName()})
+	}
+
+	// Coordinator first, then by id, so the same group always looks the same
+	sort.Slice(exported.Players, func(i, j int) bool {
+		iCoordinator := exported.Players[i].Id == exported.CoordinatorId
+		jCoordinator := exported.Players[j].Id == exported.CoordinatorId
+		if iCoordinator != jCoordinator {
+			return iCoordinator
+		}
+		return exported.Players[i].Id < exported.Players[j].Id
+	})
+
+	return exported
+}
+
+// exportedGroups converts a group map to a list of ExportedGroups sorted by coordinator
+func exportedGroups(groups map[string]Group) []ExportedGroup {
+	exported := make([]ExportedGroup, 0, len(groups))
+	for _, group := range groups {
+		exported = append(exported, exportedGroupFromGroup(group))
 	}
 
+	sort.Slice(exported, func(i, j int) bool {
+		return exported[i].CoordinatorId < exported[j].CoordinatorId
+	})
+
 	return exported
 }
 
 // GetGroups returns a list of al ExportedGroups
 func (app *App) GetGroups() ([]byte, error) {
-	groups := make([]ExportedGroup, 0, 64)
-
 	app.groupsLock.RLock()
-	for _, group := range app.groups {
-		groups = append(groups, exportedGroupFromGroup(group))
-	}
+	groups := exportedGroups(app.groups)
 	app.groupsLock.RUnlock()
 
 	return json.Marshal(groups)
@@ -60,6 +99,15 @@ func (app *App) GetGroup(id string) ([]byte, error) {
 	return nil, fmt.Errorf("404")
 }
 
+// IsKnownGroup returns true if id is one of the current groups.  Groups are indexed by coordinator.
+func (app *App) IsKnownGroup(id string) bool {
+	app.groupsLock.RLock()
+	defer app.groupsLock.RUnlock()
+
+	_, ok := app.groups[id]
+	return ok
+}
+
 func (app *App) GetPlayers() ([]byte, error) {
 	players := make([]Player, 0, 64)
 
@@ -95,6 +143,271 @@ func (app *App) GetPlayer(id string) ([]byte, error) {
 	return nil, fmt.Errorf("404")
 }
 
+// IsKnownPlayer returns true if id is a player in one of the current groups
+func (app *App) IsKnownPlayer(id string) bool {
+	app.groupsLock.RLock()
+	defer app.groupsLock.RUnlock()
+
+	for _, group := range app.groups {
+		if player, ok := group.Players[id]; ok && player != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDiscovery returns the stats from the most recent discovery scan
+func (app *App) GetDiscovery() ([]byte, error) {
+	app.scanLock.RLock()
+	stats := app.scanStats
+	app.scanLock.RUnlock()
+
+	return json.Marshal(stats)
+}
+
+// Stats are counters for things that go wrong quietly, and a history of how stable things have been
+type Stats struct {
+	ParseFailures   uint64 `json:"parseFailures"`
+	PublishFailures uint64 `json:"publishFailures"`
+
+	Started       time.Time                `json:"started"`
+	Uptime        uint64                   `json:"uptime"`
+	Rediscoveries uint64                   `json:"rediscoveries"`
+	Players       map[string]PlayerHistory `json:"players"`
+}
+
+// GetStats returns the failure counters, uptime, and the connection history of each player
+func (app *App) GetStats() ([]byte, error) {
+	stats := Stats{ParseFailures: GetParseFailures()}
+
+	app.publishFailureLock.Lock()
+	stats.PublishFailures = app.publishFailures
+	app.publishFailureLock.Unlock()
+
+	app.historyLock.Lock()
+	stats.Started = app.startTime
+	stats.Uptime = uint64(time.Since(app.startTime).Seconds())
+	stats.Rediscoveries = app.rediscoveries
+	stats.Players = make(map[string]PlayerHistory, len(app.playerHistory))
+	for id, history := range app.playerHistory {
+		stats.Players[id] = *history
+	}
+	app.historyLock.Unlock()
+
+	return json.Marshal(stats)
+}
+
+// Health is a quick summary of whether we are doing our job, for container healthchecks and such
+type Health struct {
+	Healthy          bool       `json:"healthy"`
+	State            string     `json:"state"`
+	Groups           int        `json:"groups"`
+	Players          int        `json:"players"`
+	ConnectedPlayers int        `json:"connectedPlayers"`
+	MQTTConnected    bool       `json:"mqttConnected"`
+	LastGoodScan     *time.Time `json:"lastGoodScan,omitempty"`
+}
+
+// GetHealth returns the health, and whether we are healthy.  That means we are listening for events
+// and the broker is there to publish them to.
+func (app *App) GetHealth() ([]byte, bool, error) {
+	health := Health{}
+
+	app.stateLock.RLock()
+	state := app.reportedState
+	app.stateLock.RUnlock()
+	health.State = state.String()
+
+	app.groupsLock.RLock()
+	health.Groups = len(app.groups)
+	for _, group := range app.groups {
+		for _, player := range group.Players {
+			health.Players = health.Players + 1
+			if player.HasWebsocket() {
+				health.ConnectedPlayers = health.ConnectedPlayers + 1
+			}
+		}
+	}
+	app.groupsLock.RUnlock()
+
+	app.scanLock.RLock()
+	if !app.lastGoodScan.IsZero() {
+		lastGoodScan := app.lastGoodScan
+		health.LastGoodScan = &lastGoodScan
+	}
+	app.scanLock.RUnlock()
+
+	health.MQTTConnected = app.mqttClient != nil && app.mqttClient.IsConnected()
+	health.Healthy = state == Listen && health.MQTTConnected
+
+	body, err := json.Marshal(health)
+	return body, health.Healthy, err
+}
+
+// ExportedCoordinator tells a caller which group a player is in, and who is running it
+type ExportedCoordinator struct {
+	CoordinatorId string `json:"coordinatorId"`
+	GroupId       string `json:"groupId"`
+}
+
+// GetCoordinator returns the coordinator and group for any player
+func (app *App) GetCoordinator(id string) ([]byte, error) {
+	app.groupsLock.RLock()
+	group, ok := findGroupForPlayer(app.groups, id)
+	app.groupsLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("404")
+	}
+
+	player := group.Players[id]
+
+	return json.Marshal(ExportedCoordinator{
+		CoordinatorId: player.GetCoordinatorId(),
+		GroupId:       player.GetGroupId(),
+	})
+}
+
+// SetEQ sets bass, treble, loudness, and/or balance on a single player.  Only the values in the
+// body are changed.
+func (app *App) SetEQ(id string, body []byte) ([]byte, error) {
+	settings := sonos.PlayerSettings{}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return nil, fmt.Errorf("400")
+	}
+
+	if !inRange(settings.Bass, -10, 10) || !inRange(settings.Treble, -10, 10) || !inRange(settings.Balance, -100, 100) {
+		return nil, fmt.Errorf("400")
+	}
+
+	// Send along what we parsed so nothing unexpected sneaks through
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.PostDataREST(id, "settings", "setPlayerSettings", settingsJSON)
+}
+
+// HomeTheaterRequest is the body for SetHomeTheater.  TV switches the player to its TV input.
+type HomeTheaterRequest struct {
+	sonos.HomeTheaterOptions
+	TV bool `json:"tv,omitempty"`
+}
+
+// SetHomeTheater sets night mode and/or speech enhancement on a home theater player, and can switch
+// it to the TV input.
+func (app *App) SetHomeTheater(id string, body []byte) ([]byte, error) {
+	request := HomeTheaterRequest{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("400")
+	}
+
+	var response []byte = []byte("{}")
+
+	if request.NightMode != nil || request.EnhanceDialog != nil {
+		optionsJSON, err := json.Marshal(request.HomeTheaterOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		if response, err = app.PostDataREST(id, "homeTheater", "setOptions", optionsJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.TV {
+		return app.PostDataREST(id, "homeTheater", "loadHomeTheaterPlayback", []byte("{}"))
+	}
+
+	return response, nil
+}
+
+func inRange(value *int, min int, max int) bool {
+	return value == nil || (*value >= min && *value <= max)
+}
+
+// FetchArt grabs album art on behalf of a browser, which likely can't deal with the player certs.  Relative
+// URLs are resolved against the player, and anything not served by the player is refused.  Returns the
+// image and its content type.
+func (app *App) FetchArt(id string, artUrl string) ([]byte, string, error) {
+	var player Player = nil
+
+	app.groupsLock.RLock()
+	for _, group := range app.groups {
+		if p, ok := group.Players[id]; ok {
+			player = p
+			break
+		}
+	}
+	app.groupsLock.RUnlock()
+
+	if player == nil {
+		return nil, "", fmt.Errorf("404")
+	}
+
+	fullUrl, err := url.Parse(resolveImageUrl(player, artUrl))
+	if err != nil {
+		return nil, "", fmt.Errorf("400")
+	}
+
+	if fullUrl.Scheme != "http" && fullUrl.Scheme != "https" {
+		return nil, "", fmt.Errorf("400")
+	}
+
+	// Only fetch from the player itself, otherwise we are an open proxy into the local network
+	restUrl, err := url.Parse(player.CreateFullRESTUrl(""))
+	if err != nil || !strings.EqualFold(fullUrl.Hostname(), restUrl.Hostname()) {
+		log.Debugf("art: refusing URL=%s for player %s", fullUrl.String(), id)
+		return nil, "", fmt.Errorf("400")
+	}
+
+	log.Debugf("art: GET URL=%s", fullUrl.String())
+
+	response, err := newPlayerHTTPClient().Get(fullUrl.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("code: %d", response.StatusCode)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(data)
+	}
+
+	return data, contentType, nil
+}
+
+// GetEventHistory returns the last few payloads published to a topic, oldest first.  Debug only.
+func (app *App) GetEventHistory(topic string) ([]byte, error) {
+	if !app.config.Debug {
+		return nil, fmt.Errorf("404")
+	}
+
+	app.eventHistoryLock.Lock()
+	history, ok := app.eventHistory[topic]
+	payloads := make([]string, 0, len(history))
+	for _, body := range history {
+		payloads = append(payloads, string(body))
+	}
+	app.eventHistoryLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("404")
+	}
+
+	return json.Marshal(payloads)
+}
+
 func getPlayerForNamespace(groupMap *map[string]Group, id string, namespace string) (Player, string) {
 
 	playerTargeted := sonos.IsPlayerTargetedCommand(namespace)
@@ -144,7 +457,77 @@ func (app *App) GetDataREST(id string, namespace string, object string) ([]byte,
 	} else {
 		fullpath = fmt.Sprintf("%s/%s", path, namespace)
 	}
-	return app.playerDoGET(player, fullpath)
+
+	// The path is per group or per player, so any player in a group shares the group entries
+	if body, ok := app.cachedREST(fullpath); ok {
+		return body, nil
+	}
+
+	body, err := app.playerDoGET(player, fullpath)
+	if err == nil {
+		app.cacheREST(fullpath, namespace, body)
+	}
+	return body, err
+}
+
+// restCacheEntry is a GET response we can hand out again until it expires or an event says it changed
+type restCacheEntry struct {
+	namespace string
+	body      []byte
+	expires   time.Time
+}
+
+// cachedREST returns the cached response for a REST path if there is one and it is fresh
+func (app *App) cachedREST(fullpath string) ([]byte, bool) {
+	if app.config.Sonos.RestCacheTTL == 0 {
+		return nil, false
+	}
+
+	app.restCacheLock.Lock()
+	defer app.restCacheLock.Unlock()
+
+	entry, ok := app.restCache[fullpath]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+// cacheREST remembers a GET response for RestCacheTTL milliseconds.  Expired entries are tossed here
+// so the cache can't grow without bound.
+func (app *App) cacheREST(fullpath string, namespace string, body []byte) {
+	if app.config.Sonos.RestCacheTTL == 0 {
+		return
+	}
+
+	app.restCacheLock.Lock()
+	defer app.restCacheLock.Unlock()
+
+	now := time.Now()
+	for key, entry := range app.restCache {
+		if now.After(entry.expires) {
+			delete(app.restCache, key)
+		}
+	}
+
+	app.restCache[fullpath] = restCacheEntry{
+		namespace: namespace,
+		body:      body,
+		expires:   now.Add(time.Duration(app.config.Sonos.RestCacheTTL) * time.Millisecond),
+	}
+}
+
+// invalidateREST drops everything cached for a namespace.  Called when we get an event for it, or
+// send a command to it, since the cached copy is probably wrong now.
+func (app *App) invalidateREST(namespace string) {
+	app.restCacheLock.Lock()
+	defer app.restCacheLock.Unlock()
+
+	for key, entry := range app.restCache {
+		if entry.namespace == namespace {
+			delete(app.restCache, key)
+		}
+	}
 }
 
 func (app *App) PostDataREST(id string, namespace string, command string, body []byte) ([]byte, error) {
@@ -156,39 +539,368 @@ func (app *App) PostDataREST(id string, namespace string, command string, body [
 		return nil, fmt.Errorf("404")
 	}
 
+	app.invalidateREST(namespace)
 	return app.playerDoPOST(player, fmt.Sprintf("%s/%s/%s", path, namespace, command), body)
 }
 
-func (app *App) CommandOverWebsocket(id string, namespace string, command string, callback func(sonos.WebsocketResponse)) error {
+// PlayerCommandResult is what one player said when we sent it a command as part of a group
+type PlayerCommandResult struct {
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// GroupCommand sends a player command to every player in a group (mute them all, for example), and
+// returns what each of them said indexed by PlayerId.  Only player namespaces make sense here since
+// group namespaces already apply to the whole group.
+func (app *App) GroupCommand(id string, namespace string, command string, body []byte) ([]byte, error) {
+	if !sonos.IsPlayerTargetedCommand(namespace) {
+		return nil, fmt.Errorf("400")
+	}
+
 	app.groupsLock.RLock()
-	player, _ := getPlayerForNamespace(&app.groups, id, namespace)
+	group, ok := app.groups[id]
 	app.groupsLock.RUnlock()
 
-	if player == nil {
-		return fmt.Errorf("404")
+	if !ok {
+		return nil, fmt.Errorf("404")
 	}
 
-	// Form a message and fire it down the websocket
-	if err := player.SendCommandViaWebsocket(namespace, command, callback); err != nil {
-		return fmt.Errorf("500: %s", err.Error())
+	results := map[string]PlayerCommandResult{}
+	for playerId, player := range group.Players {
+		response, err := app.playerDoPOST(player, fmt.Sprintf("/players/%s/%s/%s", playerId, namespace, command), body)
+
+		result := PlayerCommandResult{}
+		if err != nil {
+			result.Error = err.Error()
+		} else if json.Valid(response) {
+			result.Response = response
+		}
+		results[playerId] = result
 	}
 
-	return nil
+	return json.Marshal(results)
 }
 
-func (app *App) RequestOverWebsocket(request sonos.WebsocketRequest, callback func(sonos.WebsocketResponse)) {
+// PlayersNamespace GETs a namespace from every player at once (every volume for a dashboard, for example)
+// and returns what each of them said indexed by PlayerId.  Group namespaces work too, and every player in
+// a group gets the same answer.  Requests go out a few at a time, same as opening websockets.
+func (app *App) PlayersNamespace(namespace string) ([]byte, error) {
 	app.groupsLock.RLock()
-	player, _ := getPlayerForNamespace(&app.groups, request.Headers.PlayerId, request.Headers.Namespace)
+	players := getPlayers(app.groups)
+	app.groupsLock.RUnlock()
+
+	workers := app.config.Sonos.OpenWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := map[string]PlayerCommandResult{}
+	slots := make(chan struct{}, workers)
+
+	for playerId := range players {
+		wg.Add(1)
+		go func(playerId string) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			response, err := app.GetDataREST(playerId, namespace, "")
+			<-slots
+
+			result := PlayerCommandResult{}
+			if err != nil {
+				result.Error = err.Error()
+			} else if json.Valid(response) {
+				result.Response = response
+			}
+
+			lock.Lock()
+			results[playerId] = result
+			lock.Unlock()
+		}(playerId)
+	}
+	wg.Wait()
+
+	return json.Marshal(results)
+}
+
+// UngroupResult is returned from UngroupAll so the caller can tell which players are still grouped
+type UngroupResult struct {
+	Ungrouped []string `json:"ungrouped"`
+	Failed    []string `json:"failed"`
+}
+
+// UngroupAll splits every group so that each player is standalone.  We ask each coordinator to drop
+// the rest of its players, and report any players that we could not remove.
+func (app *App) UngroupAll() ([]byte, error) {
+	app.groupsLock.RLock()
+	groups := make([]Group, 0, len(app.groups))
+	for _, group := range app.groups {
+		groups = append(groups, group)
+	}
+	app.groupsLock.RUnlock()
+
+	result := UngroupResult{
+		Ungrouped: make([]string, 0, 64),
+		Failed:    make([]string, 0, 64),
+	}
+
+	for _, group := range groups {
+		coordinator := group.Coordinator
+
+		toRemove := make([]string, 0, len(group.Players))
+		for id := range group.Players {
+			if id != coordinator.GetId() {
+				toRemove = append(toRemove, id)
+			}
+		}
+
+		if len(toRemove) == 0 {
+			continue
+		}
+
+		body, err := json.Marshal(struct {
+			PlayerIdsToRemove []string `json:"playerIdsToRemove"`
+		}{
+			PlayerIdsToRemove: toRemove,
+		})
+
+		if err == nil {
+			path := fmt.Sprintf("/groups/%s/groups/modifyGroupMembers", group.Id)
+			_, err = app.playerDoPOST(coordinator, path, body)
+		}
+
+		if err != nil {
+			log.Errorf("app: unable to ungroup %s: %s", coordinator.GetId(), err.Error())
+			result.Failed = append(result.Failed, toRemove...)
+		} else {
+			result.Ungrouped = append(result.Ungrouped, toRemove...)
+		}
+	}
+
+	return json.Marshal(result)
+}
+
+// CommandOverWebsocket sends a command with no body to a player.  It is just RequestOverWebsocket with
+// the request filled in for you.
+func (app *App) CommandOverWebsocket(id string, namespace string, command string, callback func(sonos.WebsocketResponse)) error {
+	request := sonos.WebsocketRequest{
+		Headers: sonos.RequestHeaders{
+			CommonHeaders: sonos.CommonHeaders{
+				Namespace: namespace,
+				Command:   command,
+				PlayerId:  id,
+			},
+		},
+		BodyJSON: []byte{},
+	}
+
+	return app.RequestOverWebsocket(request, callback)
+}
+
+// RequestOverWebsocket passes a request straight through to the player's websocket.  The player is picked
+// from the playerId header, or the groupId if there is no playerId, and group namespaces go to the
+// coordinator.  The household and group are filled in since the caller can't be expected to know them.
+//
+// Returns a 404 if there is no such player.  Otherwise the callback is always called exactly once, with
+// the player's response, a timeout, or a failure response if the request never made it to the player.
+func (app *App) RequestOverWebsocket(request sonos.WebsocketRequest, callback func(sonos.WebsocketResponse)) error {
+	id := request.Headers.PlayerId
+	if id == "" {
+		id = groupIdToCoordinatorId(request.Headers.GroupId)
+	}
+
+	app.groupsLock.RLock()
+	player, _ := getPlayerForNamespace(&app.groups, id, request.Headers.Namespace)
 	app.groupsLock.RUnlock()
 
 	if player == nil {
-		log.Errorf("unable to find player: %s", request.Headers.PlayerId)
-		return
+		log.Errorf("app: unable to find player for websocket request: %s", id)
+		return fmt.Errorf("404")
 	}
 
 	request.Headers.HouseholdId = player.GetHouseholdId()
 	request.Headers.GroupId = player.GetGroupId()
-	player.SendRequestViaWebsocket(request, func(response sonos.WebsocketResponse) {
+	request.Headers.PlayerId = player.GetId()
+
+	// A failed send has already called back, but no websocket at all has not
+	var answered int32
+	err := player.SendRequestViaWebsocket(request, func(response sonos.WebsocketResponse) {
+		atomic.StoreInt32(&answered, 1)
 		callback(response)
 	})
+
+	if err != nil && atomic.LoadInt32(&answered) == 0 {
+		callback(bouncedResponse(request, err.Error()))
+	}
+
+	return nil
+}
+
+// bouncedResponse is what we tell the caller when a request never made it to the player.  It looks like a
+// failed command so callers don't need to handle it any differently.
+func bouncedResponse(request sonos.WebsocketRequest, reason string) sonos.WebsocketResponse {
+	return sonos.WebsocketResponse{
+		Headers: sonos.ResponseHeaders{
+			CommonHeaders: sonos.CommonHeaders{
+				Namespace: request.Headers.Namespace,
+				Command:   request.Headers.Command,
+				CmdId:     request.Headers.CmdId,
+			},
+			Response: reason,
+			Success:  false,
+			Type:     "none",
+		},
+		BodyJSON: []byte{},
+	}
+}
+
+// RawWebsocketRequest is the body for RawRequestOverWebsocket.  Body is passed along untouched.
+type RawWebsocketRequest struct {
+	Namespace string          `json:"namespace"`
+	Command   string          `json:"command"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+// RawRequestOverWebsocket sends an arbitrary request to a player and waits for the response.  The
+// player always calls back, even if it is just to tell us the command timed out.
+func (app *App) RawRequestOverWebsocket(id string, body []byte) ([]byte, error) {
+	raw := RawWebsocketRequest{}
+	if err := json.Unmarshal(body, &raw); err != nil || raw.Namespace == "" || raw.Command == "" {
+		return nil, fmt.Errorf("400")
+	}
+
+	request := sonos.WebsocketRequest{
+		Headers: sonos.RequestHeaders{
+			CommonHeaders: sonos.CommonHeaders{
+				Namespace: raw.Namespace,
+				Command:   raw.Command,
+				PlayerId:  id,
+			},
+		},
+		BodyJSON: raw.Body,
+	}
+
+	responseChan := make(chan sonos.WebsocketResponse, 1)
+	if err := app.RequestOverWebsocket(request, func(response sonos.WebsocketResponse) {
+		responseChan <- response
+	}); err != nil {
+		return nil, err
+	}
+
+	response := <-responseChan
+	return response.ToRawBytes()
+}
+
+// GetGroupsRaw returns the last groups response from a player, untouched.  Debug mode only.
+func (app *App) GetGroupsRaw() ([]byte, error) {
+	if !app.config.Debug {
+		return nil, fmt.Errorf("404")
+	}
+
+	app.groupsLock.RLock()
+	raw := app.lastGroupsRaw
+	app.groupsLock.RUnlock()
+
+	if raw == nil {
+		return nil, fmt.Errorf("404")
+	}
+
+	return raw, nil
+}
+
+// SetSubscription subscribes to (or unsubscribes from) a namespace on every player it applies to.  The
+// subscription sticks across rebuilds.  Returns the namespaces currently subscribed to at runtime.
+func (app *App) SetSubscription(namespace string, subscribe bool) ([]byte, error) {
+	command := "subscribe"
+
+	app.subscriptionsLock.Lock()
+	if subscribe {
+		app.runtimeSubscriptions[namespace] = true
+	} else if app.runtimeSubscriptions[namespace] {
+		command = "unsubscribe"
+		delete(app.runtimeSubscriptions, namespace)
+	} else {
+		app.subscriptionsLock.Unlock()
+		return nil, fmt.Errorf("404")
+	}
+
+	namespaces := make([]string, 0, len(app.runtimeSubscriptions))
+	for n := range app.runtimeSubscriptions {
+		namespaces = append(namespaces, n)
+	}
+	app.subscriptionsLock.Unlock()
+
+	// Now tell the players
+	playerTargeted := sonos.IsPlayerTargetedCommand(namespace)
+
+	players := make([]Player, 0, 32)
+
+	app.groupsLock.RLock()
+	for _, group := range app.groups {
+		for _, player := range group.Players {
+			if playerTargeted || group.Coordinator.GetId() == player.GetId() {
+				players = append(players, player)
+			}
+		}
+	}
+	app.groupsLock.RUnlock()
+
+	for _, player := range players {
+		if err := player.SendCommandViaWebsocket(namespace, command, nil); err != nil {
+			log.Errorf("app: unable to %s to %s on %s: %s", command, namespace, player.GetId(), err.Error())
+		}
+	}
+
+	sort.Strings(namespaces)
+	return json.Marshal(namespaces)
+}
+
+// PublishingState is returned when pausing or resuming publishing
+type PublishingState struct {
+	Paused bool `json:"paused"`
+}
+
+// SetPublishing pauses or resumes publishing events to MQTT.  Action is either pause or resume.
+func (app *App) SetPublishing(action string) ([]byte, error) {
+	switch action {
+	case "pause":
+		app.SetPublishingPaused(true)
+	case "resume":
+		app.SetPublishingPaused(false)
+	default:
+		return nil, fmt.Errorf("404")
+	}
+
+	return json.Marshal(PublishingState{Paused: action == "pause"})
+}
+
+// SetHouseholdPublishing pauses or resumes publishing for a household.  We only bridge one household
+// today, so this is SetPublishing for that one and a 404 for anything else.  Once more than one
+// household is supported this is where publishing gets split up per household.
+func (app *App) SetHouseholdPublishing(householdId string, action string) ([]byte, error) {
+	app.groupsLock.RLock()
+	current := ""
+	for _, group := range app.groups {
+		current = group.Coordinator.GetHouseholdId()
+		break
+	}
+	app.groupsLock.RUnlock()
+
+	if len(current) == 0 || current != householdId {
+		return nil, fmt.Errorf("404")
+	}
+
+	return app.SetPublishing(action)
+}
+
+// IsTopicAllowed only allows subscriptions to the topics under our base topic
+func (app *App) IsTopicAllowed(topic string) bool {
+	base := app.config.MQTT.Topic
+	if len(base) == 0 {
+		return false
+	}
+
+	return topic == base || strings.HasPrefix(topic, base+"/")
 }
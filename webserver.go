@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +17,7 @@ import (
 	"github.com/swmerc/sonosmqtt/sonos"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 type WebDataInterface interface {
@@ -20,16 +26,60 @@ type WebDataInterface interface {
 	GetGroup(id string) ([]byte, error)
 	GetPlayers() ([]byte, error)
 	GetPlayer(id string) ([]byte, error)
+	GetCoordinator(id string) ([]byte, error)
+	IsKnownGroup(id string) bool
+	IsKnownPlayer(id string) bool
+	GetDiscovery() ([]byte, error)
+	GetStats() ([]byte, error)
+	GetHealth() ([]byte, bool, error)
+	GetMetrics() ([]byte, error)
+
+	// Album art, fetched via the player so browsers don't have to deal with the certs
+	FetchArt(id string, artUrl string) ([]byte, string, error)
 
 	// Stuff that is just a passthrough to the normal Sonos API (currently via REST)
 	GetDataREST(id string, namespace string, command string) ([]byte, error)
 	PostDataREST(id string, namespace string, command string, body []byte) ([]byte, error)
 
+	// Player commands that would otherwise require knowing the Sonos namespaces
+	SetEQ(id string, body []byte) ([]byte, error)
+	SetHomeTheater(id string, body []byte) ([]byte, error)
+	Say(id string, body []byte) ([]byte, error)
+
+	// Player commands sent to every player in a group
+	GroupCommand(id string, namespace string, command string, body []byte) ([]byte, error)
+
+	// Namespace GET from every player at once
+	PlayersNamespace(namespace string) ([]byte, error)
+
+	// Household wide commands
+	UngroupAll() ([]byte, error)
+
+	// Subscribe to a namespace on the fly, or unsubscribe from one we subscribed to on the fly
+	SetSubscription(namespace string, subscribe bool) ([]byte, error)
+
+	// Pause or resume publishing to MQTT, for broker maintenance and such
+	SetPublishing(action string) ([]byte, error)
+	SetHouseholdPublishing(householdId string, action string) ([]byte, error)
+
+	// Debug hackery to see what we published to a topic
+	GetEventHistory(topic string) ([]byte, error)
+
+	// More debug hackery to see the last groups response we got from Sonos
+	GetGroupsRaw() ([]byte, error)
+
 	// Debug hackery to send a command over a websocket.
 	CommandOverWebsocket(id string, namespace string, command string, callback func(sonos.WebsocketResponse)) error
 
-	// Real function to send data over a websocket and await a response
-	RequestOverWebsocket(request sonos.WebsocketRequest, callback func(sonos.WebsocketResponse))
+	// Real function to send data over a websocket and await a response.  The callback always runs unless
+	// there is an error.
+	RequestOverWebsocket(request sonos.WebsocketRequest, callback func(sonos.WebsocketResponse)) error
+
+	// Same thing, but blocks and hands back the raw response for the REST API
+	RawRequestOverWebsocket(id string, body []byte) ([]byte, error)
+
+	// Returns true if websocket users may subscribe to the MQTT topic
+	IsTopicAllowed(topic string) bool
 }
 
 type websocketUser struct {
@@ -38,6 +88,9 @@ type websocketUser struct {
 	mqtt mqtt.Client
 	data WebDataInterface
 
+	// MQTT topics the user subscribed to, so we can drop them when asked or when the websocket closes
+	topics map[string]bool
+
 	// Lock when accessing the above.  It is safe to take a reference of
 	// ws and mqtt under the lock and use it later, but they may become nil
 	// at any point so you do want to make sure it is still valid
@@ -54,103 +107,400 @@ var users = websocketUsers{
 	users: make(map[string]*websocketUser),
 }
 
-func StartWebServer(port int, data WebDataInterface) {
+// StartWebServer starts serving the API in the background.  It hands back the server so the caller
+// can shut it down, and a channel that gets the error if the listener dies (port in use, etc).  What
+// to do about that is up to the caller.  The bridge works fine without the API.
+func StartWebServer(port int, logRequests bool, data WebDataInterface) (*http.Server, <-chan error) {
+	router := mux.NewRouter()
+
+	if logRequests {
+		router.Use(requestLogger)
+	}
+	router.Use(gzipResponses)
+	router.Use(validatePathVars(data))
+
+	// FIXME: Create a router for /api/v1/ to make the paths shorter?
+
+	//
+	// Simple GETs
+	//
+	router.HandleFunc("/api/v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetGroups()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/discovery", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetDiscovery()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetStats()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	// Prometheus wants it at the top, not under the API
+	router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetMetrics()
+		if err == nil {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	// Healthchecks only look at the status, so that is where unhealthy goes
+	router.HandleFunc("/api/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		bytes, healthy, err := data.GetHealth()
+		if err == nil && !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/group/{id}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetGroup(mux.Vars(r)["id"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/players", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetPlayers()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/players/{namespace}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.PlayersNamespace(mux.Vars(r)["namespace"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/player/{id}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetPlayer(mux.Vars(r)["id"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	// These have to come before the namespace passthrough below or they will be treated as namespaces
+	router.HandleFunc("/api/v1/player/{id}/coordinator", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetCoordinator(mux.Vars(r)["id"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/player/{id}/art", func(w http.ResponseWriter, r *http.Request) {
+		artUrl := r.URL.Query().Get("url")
+		if len(artUrl) == 0 {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+
+		bytes, contentType, err := data.FetchArt(mux.Vars(r)["id"], artUrl)
+		if err == nil {
+			w.Header().Set("Content-Type", contentType)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/player/{id}/eq", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.SetEQ(mux.Vars(r)["id"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/player/{id}/hometheater", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.SetHomeTheater(mux.Vars(r)["id"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/player/{id}/say", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.Say(mux.Vars(r)["id"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	// Full websocket access: {namespace, command, body} in, raw [headers, body] response out
+	router.HandleFunc("/api/v1/player/{id}/ws", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.RawRequestOverWebsocket(mux.Vars(r)["id"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	//
+	// Commands that return unfiltered Sonos responses.  There is some magic mapping going on under
+	// the covers, so you can pass the of any player in the group to get group information.
+	//
+	router.HandleFunc("/api/v1/player/{id}/{namespace}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], "")
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/player/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], mux.Vars(r)["command"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/player/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.PostDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], mux.Vars(r)["command"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	// Player commands for every player in the group, like muting all of them
+	router.HandleFunc("/api/v1/group/{id}/all/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		bytes := make([]byte, 0)
+		if err == nil {
+			bytes, err = data.GroupCommand(mux.Vars(r)["id"], mux.Vars(r)["namespace"], mux.Vars(r)["command"], body)
+		}
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	//
+	// Household wide commands
+	//
+	router.HandleFunc("/api/v1/ungroupall", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.UngroupAll()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/subscribe/{namespace}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.SetSubscription(mux.Vars(r)["namespace"], true)
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/unsubscribe/{namespace}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.SetSubscription(mux.Vars(r)["namespace"], false)
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/publishing/{action}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.SetPublishing(mux.Vars(r)["action"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/household/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.SetHouseholdPublishing(mux.Vars(r)["id"], mux.Vars(r)["action"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/api/v1/debug/groups/raw", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetGroupsRaw()
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	// Topics have slashes in them, so grab the rest of the path
+	router.HandleFunc("/api/v1/debug/events/{topic:.+}", func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := data.GetEventHistory(mux.Vars(r)["topic"])
+		writeResponse(w, &bytes, err)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/api/v1/wstest/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		responseChan := make(chan sonos.WebsocketResponse, 1)
+		err := data.CommandOverWebsocket(mux.Vars(r)["id"],
+			mux.Vars(r)["namespace"],
+			mux.Vars(r)["command"],
+			func(resp sonos.WebsocketResponse) {
+				responseChan <- resp
+			})
+
+		// If it failed immediately we already know why, and the callback only went to the channel.
+		if err != nil {
+			writeResponse(w, &[]byte{}, err)
+			return
+		}
+
+		// If it did not fail immediately it should respond, but don't hang the request if it doesn't
+		raw, err := awaitWebsocketResponse(responseChan, wsTestTimeout)
+		writeResponse(w, &raw, err)
+
+	}).Methods(http.MethodPost)
+
+	//
+	// Websocket that can take Sonos control API commands and return events.  Wooo?
+	//
+	router.HandleFunc("/api/v1/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebsocketUpgrade(w, r, data)
+	}).Methods(http.MethodGet)
+
+	// Fire it up
+	srv := &http.Server{
+		Handler:      router,
+		Addr:         fmt.Sprintf(":%d", port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	errors := make(chan error, 1)
 	go func() {
-		router := mux.NewRouter()
-
-		// FIXME: Create a router for /api/v1/ to make the paths shorter?
-
-		//
-		// Simple GETs
-		//
-		router.HandleFunc("/api/v1/groups", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetGroups()
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		router.HandleFunc("/api/v1/group/{id}", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetGroup(mux.Vars(r)["id"])
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		router.HandleFunc("/api/v1/players", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetPlayers()
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		router.HandleFunc("/api/v1/player/{id}", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetPlayer(mux.Vars(r)["id"])
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		//
-		// Commands that return unfiltered Sonos responses.  There is some magic mapping going on under
-		// the covers, so you can pass the of any player in the group to get group information.
-		//
-		router.HandleFunc("/api/v1/player/{id}/{namespace}", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], "")
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		router.HandleFunc("/api/v1/player/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
-			bytes, err := data.GetDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], mux.Vars(r)["command"])
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodGet)
-
-		router.HandleFunc("/api/v1/player/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
-			body, err := io.ReadAll(r.Body)
-			bytes := make([]byte, 0)
-			if err == nil {
-				bytes, err = data.PostDataREST(mux.Vars(r)["id"], mux.Vars(r)["namespace"], mux.Vars(r)["command"], body)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errors <- err
+		}
+		close(errors)
+	}()
+
+	return srv, errors
+}
+
+//
+// Request logging
+//
+
+// statusRecorder grabs the status code on the way out so we can log it.  It has to pass along
+// Hijack or websocket upgrades will fail.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		log.Infof("web: %s %s %s: %d (%s)", r.RemoteAddr, r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+//
+// Response compression
+//
+
+// gzipResponseWriter sends everything written through a gzip.Writer
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.gz.Write(data)
+}
+
+// gzipResponses compresses responses for clients that ask for it.  Websocket upgrades are left alone.
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+
+		next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	})
+}
+
+// What we expect to see in the path variables that end up in player URLs.  Ids are things like
+// RINCON_000E58C0FFEE01400 (or RINCON_000E58C0FFEE01400:123 for groups), and namespaces and commands
+// are camelCase.  Anything else is rejected before it gets anywhere near a URL.
+var pathVarPatterns = map[string]*regexp.Regexp{
+	"id":        regexp.MustCompile(`^[A-Za-z0-9_:.-]+$`),
+	"namespace": regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`),
+	"command":   regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`),
+}
+
+// validatePathVars returns a 400 for requests with path variables that don't look like Sonos ids,
+// namespaces, or commands, and a 404 for player and group ids we don't know about
+func validatePathVars(data WebDataInterface) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			for name, value := range vars {
+				if pattern, ok := pathVarPatterns[name]; ok && !pattern.MatchString(value) {
+					writeResponse(w, nil, fmt.Errorf("400"))
+					return
+				}
 			}
-			writeResponse(w, &bytes, err)
-		}).Methods(http.MethodPost)
-
-		router.HandleFunc("/api/v1/wstest/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
-			var responseChan chan sonos.WebsocketResponse
-			err := data.CommandOverWebsocket(mux.Vars(r)["id"],
-				mux.Vars(r)["namespace"],
-				mux.Vars(r)["command"],
-				func(resp sonos.WebsocketResponse) {
-					responseChan <- resp
-				})
-
-			// If it failed immediately the callback was not set up.
-			if err != nil {
-				writeResponse(w, &[]byte{}, err)
+
+			if id, ok := vars["id"]; ok && !isKnownId(data, r, id) {
+				writeResponse(w, nil, fmt.Errorf("404"))
 				return
 			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			// If it did not fail immediately, it _will_ respond.
-			response := <-responseChan
-			raw, err := response.ToRawBytes()
-			writeResponse(w, &raw, err)
-
-		}).Methods(http.MethodPost)
-
-		//
-		// Websocket that can take Sonos control API commands and return events.  Wooo?
-		//
-		router.HandleFunc("/api/v1/ws", func(w http.ResponseWriter, r *http.Request) {
-			handleWebsocketUpgrade(w, r, data)
-		}).Methods(http.MethodGet)
-
-		// Fire it up
-		srv := &http.Server{
-			Handler:      router,
-			Addr:         fmt.Sprintf(":%d", port),
-			WriteTimeout: 15 * time.Second,
-			ReadTimeout:  15 * time.Second,
-		}
+// isKnownId looks the {id} up as a player or group, depending on the route.  Ids in other routes (the
+// household, for example) are left to the handler.
+func isKnownId(data WebDataInterface, r *http.Request, id string) bool {
+	route := mux.CurrentRoute(r)
+	if data == nil || route == nil {
+		return true
+	}
 
-		log.Fatal(srv.ListenAndServe())
-	}()
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return true
+	}
+
+	switch {
+	case strings.HasPrefix(template, "/api/v1/player/{id}"), strings.HasPrefix(template, "/api/v1/wstest/{id}"):
+		return data.IsKnownPlayer(id)
+	case strings.HasPrefix(template, "/api/v1/group/{id}"):
+		return data.IsKnownGroup(id)
+	}
+	return true
+}
+
+// wsTestTimeout is how long wstest waits for a player.  The player times commands out on its own, so
+// this only fires if that somehow doesn't happen.
+var wsTestTimeout = playerCmdTimeout + 2*time.Second
+
+// awaitWebsocketResponse waits for a response from a player, and returns a 504 if it never shows up
+func awaitWebsocketResponse(responseChan <-chan sonos.WebsocketResponse, timeout time.Duration) ([]byte, error) {
+	select {
+	case response := <-responseChan:
+		return response.ToRawBytes()
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("504")
+	}
 }
 
 func writeResponse(w http.ResponseWriter, data *[]byte, err error) {
 	if err != nil {
 		if err.Error() == "404" {
 			w.WriteHeader(http.StatusNotFound)
+		} else if err.Error() == "400" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err.Error() == "504" {
+			w.WriteHeader(http.StatusGatewayTimeout)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -163,11 +513,12 @@ func handleWebsocketUpgrade(w http.ResponseWriter, r *http.Request, data WebData
 	hash := r.RemoteAddr
 
 	user := websocketUser{
-		hash:  hash,
-		ws:    nil,
-		mqtt:  nil,
-		data:  data,
-		Mutex: sync.Mutex{},
+		hash:   hash,
+		ws:     nil,
+		mqtt:   nil,
+		data:   data,
+		topics: map[string]bool{},
+		Mutex:  sync.Mutex{},
 	}
 
 	ws := UpgradeToWebSocket(w, r, hash, &user)
@@ -186,7 +537,7 @@ func handleWebsocketUpgrade(w http.ResponseWriter, r *http.Request, data WebData
 func (user *websocketUser) OnConnect(userdata string) {
 	log.Infof("wsserver: connect: %s", userdata)
 
-	client, err := initMQTTClient(false)
+	client, err := initMQTTClient(false, "")
 	if err != nil {
 		log.Errorf("wsserver: can't connect to MQTT: %s", err.Error())
 		return
@@ -197,13 +548,25 @@ func (user *websocketUser) OnConnect(userdata string) {
 	user.Unlock()
 }
 
-func (user *websocketUser) OnClose(userdata string) {
+func (user *websocketUser) OnClose(userdata string, reason CloseReason) {
 	log.Infof("wsserver: close: %s", userdata)
 
 	// Kill the MQTT client and make sure we remove references to the
 	// MQTT client and websocket
 	user.Lock()
 
+	// The session isn't clean, so the broker would remember these if we didn't drop them
+	if user.mqtt != nil && len(user.topics) > 0 {
+		topics := make([]string, 0, len(user.topics))
+		for topic := range user.topics {
+			topics = append(topics, topic)
+		}
+		if token := user.mqtt.Unsubscribe(topics...); !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+			log.Errorf("wsserver: unable to unsubscribe %s from %s", userdata, strings.Join(topics, ","))
+		}
+	}
+	user.topics = map[string]bool{}
+
 	if user.mqtt != nil {
 		user.mqtt.Disconnect(0)
 	}
@@ -235,9 +598,10 @@ func (user *websocketUser) OnMessage(userdata string, bytes []byte) {
 		return
 	}
 
-	// Grab a reference to the websocket under the lock
+	// Grab references to the websocket and MQTT client under the lock
 	user.Lock()
 	wsClient := user.ws
+	mqttClient := user.mqtt
 	user.Unlock()
 
 	// Pull out subscribes and use the MQTT client to subscribe.  This is the point
@@ -250,33 +614,26 @@ func (user *websocketUser) OnMessage(userdata string, bytes []byte) {
 		log.Infof("subscribe: %s", request.Headers.Topic)
 
 		success := true
-		if user.mqtt == nil {
+		if mqttClient == nil {
 			success = false
 		}
 
-		log.Infof("wsserver: good topic, and haz client: %s", request.Headers.Topic)
-		response := sonos.WebsocketResponse{
-			Headers: sonos.ResponseHeaders{
-				CommonHeaders: sonos.CommonHeaders{
-					Command: "subscribe",
-					CmdId:   request.Headers.CmdId,
-					Topic:   request.Headers.Topic,
-				},
-				Success: success,
-				Type:    "none",
-			},
-			BodyJSON: []byte{},
+		// Only our own topics.  We are not a generic MQTT proxy.
+		if !user.data.IsTopicAllowed(request.Headers.Topic) {
+			log.Errorf("wsserver: rejecting subscribe to %s", request.Headers.Topic)
+			success = false
 		}
 
-		body, err := response.ToRawBytes()
-		if err != nil {
-			log.Errorf("wsserver: can't convert response to JSON: %s", err.Error())
-		} else {
-			user.ws.SendMessage(body)
-		}
+		user.sendTopicResponse(wsClient, &request, success)
 
 		if success {
-			user.mqtt.Subscribe(request.Headers.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+			log.Infof("wsserver: good topic, and haz client: %s", request.Headers.Topic)
+
+			user.Lock()
+			user.topics[request.Headers.Topic] = true
+			user.Unlock()
+
+			mqttClient.Subscribe(request.Headers.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
 				if wsClient != nil {
 					event := sonos.WebsocketResponse{
 						Headers: sonos.ResponseHeaders{
@@ -299,9 +656,30 @@ func (user *websocketUser) OnMessage(userdata string, bytes []byte) {
 		return
 	}
 
+	// Only topics we subscribed to, since the MQTT client is shared by everything this user did
+	if request.Headers.Command == "unsubscribe" {
+		log.Infof("unsubscribe: %s", request.Headers.Topic)
+
+		user.Lock()
+		success := user.mqtt != nil && user.topics[request.Headers.Topic]
+		delete(user.topics, request.Headers.Topic)
+		client := user.mqtt
+		user.Unlock()
+
+		if success {
+			if token := client.Unsubscribe(request.Headers.Topic); !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+				log.Errorf("wsserver: unable to unsubscribe from %s", request.Headers.Topic)
+				success = false
+			}
+		}
+
+		user.sendTopicResponse(wsClient, &request, success)
+		return
+	}
+
 	// Send it along and reply when we get a response from the player
 	log.Infof("OnMessage: sending: %v", request)
-	user.data.RequestOverWebsocket(request, func(response sonos.WebsocketResponse) {
+	reply := func(response sonos.WebsocketResponse) {
 		response.Headers.CmdId = request.Headers.CmdId
 		log.Infof("OnMessage: response: %v", response)
 		raw, err := response.ToRawBytes()
@@ -310,5 +688,37 @@ func (user *websocketUser) OnMessage(userdata string, bytes []byte) {
 		} else {
 			wsClient.SendMessage(raw)
 		}
-	})
+	}
+
+	// No player to send it to, so bounce it ourselves
+	if err := user.data.RequestOverWebsocket(request, reply); err != nil {
+		reply(bouncedResponse(request, fmt.Sprintf("no player: %s", err.Error())))
+	}
+}
+
+// sendTopicResponse answers a subscribe or unsubscribe the way a player would answer a command
+func (user *websocketUser) sendTopicResponse(wsClient WebsocketClient, request *sonos.WebsocketRequest, success bool) {
+	if wsClient == nil {
+		return
+	}
+
+	response := sonos.WebsocketResponse{
+		Headers: sonos.ResponseHeaders{
+			CommonHeaders: sonos.CommonHeaders{
+				Command: request.Headers.Command,
+				CmdId:   request.Headers.CmdId,
+				Topic:   request.Headers.Topic,
+			},
+			Success: success,
+			Type:    "none",
+		},
+		BodyJSON: []byte{},
+	}
+
+	body, err := response.ToRawBytes()
+	if err != nil {
+		log.Errorf("wsserver: can't convert response to JSON: %s", err.Error())
+	} else {
+		wsClient.SendMessage(body)
+	}
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+func TestGzipResponses(t *testing.T) {
+	handler := gzipResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[\"hello\"]"))
+	}))
+
+	// Plain
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/groups", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Body.String() != "[\"hello\"]" {
+		t.Errorf("compressed without being asked")
+	}
+
+	// Compressed
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("not compressed")
+	}
+
+	gz, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("bad gzip: %s", err.Error())
+	}
+
+	body, _ := io.ReadAll(gz)
+	if string(body) != "[\"hello\"]" {
+		t.Errorf("wrong body: %s", string(body))
+	}
+}
+
+func TestValidatePathVars(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(validatePathVars(nil))
+	router.HandleFunc("/api/v1/player/{id}/{namespace}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := map[string]int{
+		"/api/v1/player/RINCON_000E58C0FFEE01400/groupVolume/setVolume":     http.StatusOK,
+		"/api/v1/player/RINCON_000E58C0FFEE01400:123/groupVolume/setVolume": http.StatusOK,
+		"/api/v1/player/RINCON_1/groupVolume/set.Volume":                    http.StatusBadRequest,
+		"/api/v1/player/RINCON_1/group%3FVolume/setVolume":                  http.StatusBadRequest,
+		"/api/v1/player/RIN%20CON/groupVolume/setVolume":                    http.StatusBadRequest,
+	}
+
+	for path, expected := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, nil))
+
+		if recorder.Code != expected {
+			t.Errorf("wrong status for %s: %d instead of %d", path, recorder.Code, expected)
+		}
+	}
+}
+
+func TestValidatePathVarsKnownIds(t *testing.T) {
+	app := NewApp(Config{}, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	router := mux.NewRouter()
+	router.Use(validatePathVars(app))
+	for _, path := range []string{"/api/v1/player/{id}/{namespace}", "/api/v1/group/{id}", "/api/v1/household/{id}/{action}"} {
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+	}
+
+	tests := map[string]int{
+		"/api/v1/player/P2/playerVolume":   http.StatusOK,
+		"/api/v1/player/P9/playerVolume":   http.StatusNotFound,
+		"/api/v1/player/P1:1/playerVolume": http.StatusNotFound,
+		"/api/v1/group/P1":                 http.StatusOK,
+		"/api/v1/group/P2":                 http.StatusNotFound,
+		"/api/v1/household/OTHER/pause":    http.StatusOK,
+	}
+
+	for path, expected := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if recorder.Code != expected {
+			t.Errorf("wrong status for %s: %d instead of %d", path, recorder.Code, expected)
+		}
+	}
+}
+
+func TestStartWebServerPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	defer listener.Close()
+
+	// Grabbing the same port should fail without taking the process down with it
+	_, errors := StartWebServer(listener.Addr().(*net.TCPAddr).Port, false, nil)
+
+	select {
+	case err := <-errors:
+		if err == nil {
+			t.Errorf("expected an error for a port that is in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for the webserver to fail")
+	}
+}
+
+func TestAwaitWebsocketResponse(t *testing.T) {
+	responseChan := make(chan sonos.WebsocketResponse, 1)
+
+	// A player that never answers is a 504, not a hung request
+	if _, err := awaitWebsocketResponse(responseChan, 10*time.Millisecond); err == nil || err.Error() != "504" {
+		t.Errorf("expected a 504, got %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	writeResponse(recorder, &[]byte{}, fmt.Errorf("504"))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("wrong status for a timeout: %d", recorder.Code)
+	}
+
+	response := sonos.WebsocketResponse{}
+	response.Headers.Success = true
+	responseChan <- response
+	if raw, err := awaitWebsocketResponse(responseChan, time.Second); err != nil || len(raw) == 0 {
+		t.Errorf("bogus response: %s, %v", string(raw), err)
+	}
+}
+
+// recordingWebsocketClient keeps everything we send to a websocket user
+type recordingWebsocketClient struct {
+	sent [][]byte
+}
+
+func (ws *recordingWebsocketClient) SendMessage(data []byte) error {
+	ws.sent = append(ws.sent, data)
+	return nil
+}
+
+func (ws *recordingWebsocketClient) Close()          {}
+func (ws *recordingWebsocketClient) IsRunning() bool { return true }
+
+// lastResponse returns the last thing sent, as a response
+func (ws *recordingWebsocketClient) lastResponse(t *testing.T) sonos.WebsocketResponse {
+	response := sonos.WebsocketResponse{}
+	if len(ws.sent) == 0 {
+		t.Fatalf("nothing sent")
+	}
+	if err := response.FromRawBytes(ws.sent[len(ws.sent)-1]); err != nil {
+		t.Fatalf("bogus response: %s", err.Error())
+	}
+	return response
+}
+
+func TestWebsocketUnsubscribe(t *testing.T) {
+	config := Config{}
+	config.MQTT.Topic = "sonos"
+
+	ws := &recordingWebsocketClient{}
+	client := newMockMQTTClient()
+	user := &websocketUser{hash: "test", ws: ws, mqtt: client, data: NewApp(config, nil), topics: map[string]bool{}}
+
+	send := func(command string, topic string) sonos.WebsocketResponse {
+		request := sonos.WebsocketRequest{}
+		request.Headers.Command = command
+		request.Headers.CmdId = "1"
+		request.Headers.Topic = topic
+		body, _ := request.ToRawBytes()
+		user.OnMessage("test", body)
+		return ws.lastResponse(t)
+	}
+
+	send("subscribe", "sonos/player/P1/state")
+	send("subscribe", "sonos/player/P2/state")
+
+	response := send("unsubscribe", "sonos/player/P1/state")
+	if !response.Headers.Success || response.Headers.Command != "unsubscribe" || response.Headers.CmdId != "1" {
+		t.Errorf("bogus unsubscribe response: %v", response.Headers)
+	}
+
+	if client.subscribed["sonos/player/P1/state"] || !client.subscribed["sonos/player/P2/state"] {
+		t.Errorf("wrong subscriptions after unsubscribe: %v", client.subscribed)
+	}
+
+	// Can't drop what we never subscribed to
+	if response := send("unsubscribe", "sonos/player/P3/state"); response.Headers.Success {
+		t.Errorf("unsubscribe from a topic we never subscribed to worked")
+	}
+
+	// Closing drops the rest
+	user.OnClose("test", CloseReason{})
+	if len(client.subscribed) != 0 {
+		t.Errorf("close left subscriptions behind: %v", client.subscribed)
+	}
+}
+
+func TestWebsocketPassthrough(t *testing.T) {
+	defer func() { websocketInitHook = NewClientWebSocket }()
+
+	app := NewApp(Config{}, nil)
+	app.groups, _ = getGroupMap("HHID", newTestGroupsResponse(), 0)
+
+	newMockWebsocketClient()
+	if err := app.groups["P1"].Players["P1"].InitWebsocketConnection(http.Header{}, app); err != nil {
+		t.Fatalf("unable to connect P1: %s", err.Error())
+	}
+
+	ws := &recordingWebsocketClient{}
+	user := &websocketUser{hash: "test", ws: ws, data: app, topics: map[string]bool{}}
+
+	send := func(playerId string, groupId string, namespace string) sonos.WebsocketResponse {
+		request := sonos.WebsocketRequest{}
+		request.Headers.Namespace = namespace
+		request.Headers.Command = "getVolume"
+		request.Headers.PlayerId = playerId
+		request.Headers.GroupId = groupId
+		request.Headers.CmdId = "7"
+		body, _ := request.ToRawBytes()
+		user.OnMessage("test", body)
+		return ws.lastResponse(t)
+	}
+
+	// Group namespaces go to the coordinator, whether we ask by player or by group.  The mock tacks -resp
+	// on to everything it got.
+	for _, response := range []sonos.WebsocketResponse{send("P2", "", "groupVolume"), send("", "P1:1", "groupVolume")} {
+		if !response.Headers.Success || response.Headers.PlayerId != "P1-resp" || response.Headers.GroupId != "P1:1-resp" || response.Headers.CmdId != "7" {
+			t.Errorf("bogus response: %v", response.Headers)
+		}
+	}
+
+	// No websocket and no player both come back as failures instead of silence
+	if response := send("P3", "", "playerVolume"); response.Headers.Success || response.Headers.CmdId != "7" {
+		t.Errorf("request with no websocket did not bounce: %v", response.Headers)
+	}
+	if response := send("P9", "", "playerVolume"); response.Headers.Success || response.Headers.Response != "no player: 404" {
+		t.Errorf("request for a missing player did not bounce: %v", response.Headers)
+	}
+
+	// The REST flavours take the same path
+	if err := app.CommandOverWebsocket("P9", "playerVolume", "getVolume", func(sonos.WebsocketResponse) {}); err == nil || err.Error() != "404" {
+		t.Errorf("command for a missing player: %v", err)
+	}
+	if raw, err := app.RawRequestOverWebsocket("P3", []byte(`{"namespace":"playerVolume","command":"getVolume"}`)); err != nil || !strings.Contains(string(raw), "no websocket") {
+		t.Errorf("raw request with no websocket: %s, %v", string(raw), err)
+	}
+}
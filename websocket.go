@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -18,10 +20,38 @@ import (
 type WebsocketCallbacks interface {
 	OnConnect(userData string)
 	OnMessage(userData string, msg []byte)
-	OnClose(userData string)
+	OnClose(userData string, reason CloseReason)
 	OnError(userData string, err error)
 }
 
+// CloseReason says why a websocket closed.  Code and Text come from the close frame if the other end
+// sent one, and Err is whatever ended the read loop.  It is an error itself so it can be handed along
+// to things that only know about errors.
+type CloseReason struct {
+	Local bool
+	Code  int
+	Text  string
+	Err   error
+}
+
+func (r CloseReason) Error() string {
+	switch {
+	case r.Local:
+		return "closed by us"
+	case r.Code != 0:
+		return fmt.Sprintf("closed by peer: %d %s", r.Code, r.Text)
+	case r.Err != nil:
+		return r.Err.Error()
+	}
+	return "closed"
+}
+
+// IsNormal returns true if the other end closed the websocket on purpose, which is what a player does
+// when it reboots
+func (r CloseReason) IsNormal() bool {
+	return !r.Local && (r.Code == websocket.CloseNormalClosure || r.Code == websocket.CloseGoingAway)
+}
+
 // WebsocketClient is the interface for the actual code that manages the websocket
 type WebsocketClient interface {
 	SendMessage(data []byte) error
@@ -33,10 +63,11 @@ func NewClientWebSocket(url string, userData string, headers http.Header, callba
 	ws := &websocketImpl{
 		userData:    userData,
 		callbacks:   callbacks,
+		config:      websocketConfig,
 		running:     false,
 		runningLock: sync.RWMutex{},
 		conn:        &websocket.Conn{},
-		sendChan:    make(chan []byte),
+		sendChan:    make(chan []byte, sendQueueSize),
 	}
 	ws.runAsClient(url, headers)
 	return ws
@@ -58,10 +89,11 @@ func UpgradeToWebSocket(w http.ResponseWriter, r *http.Request, userdata string,
 	ws := &websocketImpl{
 		userData:    userdata,
 		callbacks:   callbacks,
+		config:      websocketConfig,
 		running:     true,
 		runningLock: sync.RWMutex{},
 		conn:        conn,
-		sendChan:    make(chan []byte),
+		sendChan:    make(chan []byte, sendQueueSize),
 	}
 
 	go ws.readGoroutine()
@@ -70,21 +102,48 @@ func UpgradeToWebSocket(w http.ResponseWriter, r *http.Request, userdata string,
 	return ws
 }
 
+// WebsocketConfig is the websocket section of the config.  It applies to websockets to the players and
+// from our own API users.
+type WebsocketConfig struct {
+	// Favorites and queues can be big, so this is a lot more than the 8KB it used to be.  Anything bigger
+	// is dropped without taking the websocket down with it.
+	MaxMessageSize int64 `yaml:"max_message_size" doc:"Largest message in bytes we take from a websocket.  Bigger ones are dropped."`
+
+	// We ping a bit more often than this, so a quiet player is still a live player
+	PongWait  uint `yaml:"pong_wait" doc:"Seconds to wait for a pong before giving up on a websocket"`
+	WriteWait uint `yaml:"write_wait" doc:"Seconds to wait for a write to a websocket to finish"`
+}
+
+func (c WebsocketConfig) pongWait() time.Duration {
+	return time.Duration(c.PongWait) * time.Second
+}
+
+// pingPeriod must be less than pongWait, or we'd give up before pinging
+func (c WebsocketConfig) pingPeriod() time.Duration {
+	return (c.pongWait() * 9) / 10
+}
+
+func (c WebsocketConfig) writeWait() time.Duration {
+	return time.Duration(c.WriteWait) * time.Second
+}
+
+// websocketConfig is used by every websocket we create.  main replaces it with the one from the config.
+var websocketConfig = WebsocketConfig{
+	MaxMessageSize: 256 * 1024,
+	PongWait:       60,
+	WriteWait:      10,
+}
+
 //
-// Some config.  Move to yaml?
+// Some config that is not worth putting in yaml
 //
 const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	// Maximum number of messages waiting to be written.  Sends fail once this fills up.
+	sendQueueSize = 64
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 8 * 1024
+	// TCP keepalive period for player connections, so NATs and firewalls that silently drop the
+	// connection are noticed between pings.
+	tcpKeepAlivePeriod = 15 * time.Second
 )
 
 var (
@@ -100,7 +159,10 @@ type websocketImpl struct {
 
 	callbacks WebsocketCallbacks
 
+	config WebsocketConfig
+
 	running     bool
+	closing     bool
 	runningLock sync.RWMutex
 
 	conn *websocket.Conn
@@ -108,23 +170,33 @@ type websocketImpl struct {
 	sendChan chan []byte
 }
 
+// SendMessage queues a message for the write goroutine.  The lock is held across the send, which is what
+// keeps readGoroutine from closing sendChan out from under us.
 func (ws *websocketImpl) SendMessage(data []byte) error {
 	ws.runningLock.RLock()
 	defer ws.runningLock.RUnlock()
 
-	if ws.running {
-		ws.sendChan <- []byte(data)
+	if !ws.running {
+		return fmt.Errorf("send while not running")
+	}
+
+	// Never block here.  We are holding the lock, and a stalled writer would take Close down with us.
+	select {
+	case ws.sendChan <- []byte(data):
 		return nil
+	default:
+		return fmt.Errorf("send queue full")
 	}
-	return fmt.Errorf("send while not running")
 }
 
 func (ws *websocketImpl) Close() {
 	var wasRunning bool
 
-	ws.runningLock.RLock()
+	// Remember that we asked for this so OnClose doesn't make it sound like the other end hung up
+	ws.runningLock.Lock()
 	wasRunning = ws.running
-	ws.runningLock.RUnlock()
+	ws.closing = true
+	ws.runningLock.Unlock()
 
 	if wasRunning {
 		ws.conn.Close()
@@ -138,9 +210,16 @@ func (ws *websocketImpl) IsRunning() bool {
 }
 
 func (ws *websocketImpl) runAsClient(url string, headers http.Header) {
-	// No time to untangle the cert mess.  Ignore it.  Ew.
+	// Same cert rules as REST, which means ignoring them unless verifytls is set
 	dialer := *websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer.TLSClientConfig = playerTLSConfig
+
+	// Same proxy rules as REST, so the two don't disagree about how to reach a player
+	dialer.Proxy = playerProxy
+
+	// Turn on TCP keepalive.  The TLS handshake happens on top of this connection.
+	netDialer := &net.Dialer{KeepAlive: tcpKeepAlivePeriod}
+	dialer.NetDial = netDialer.Dial
 
 	// Fire up the connection
 	conn, _, err := dialer.Dial(url, headers)
@@ -162,21 +241,29 @@ func (ws *websocketImpl) readGoroutine() {
 	// Tell someone we connected
 	ws.callbacks.OnConnect(ws.userData)
 
-	// Keep reading until we get an error
-	ws.conn.SetReadLimit(maxMessageSize)
-	ws.conn.SetReadDeadline(time.Now().Add(pongWait))
+	// Keep reading until we get an error.  There is no read limit on the connection since hitting it
+	// kills the websocket, so readMessage enforces it instead.
+	ws.conn.SetReadDeadline(time.Now().Add(ws.config.pongWait()))
 	ws.conn.SetPongHandler(func(string) error {
 		log.Debugf("ws: %s: pong", ws.userData)
-		ws.conn.SetReadDeadline(time.Now().Add(pongWait))
+		ws.conn.SetReadDeadline(time.Now().Add(ws.config.pongWait()))
 		return nil
 	})
 
+	var reason CloseReason
 	for {
-		_, message, err := ws.conn.ReadMessage()
+		message, err := ws.readMessage()
+		if err == errMessageTooBig {
+			log.Errorf("ws: %s: dropped a message bigger than %d bytes", ws.userData, ws.config.MaxMessageSize)
+			continue
+		}
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Errorf("ws: unexpected close")
-				ws.callbacks.OnError(ws.userData, err)
+			reason.Err = err
+
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				reason.Code = closeErr.Code
+				reason.Text = closeErr.Text
 			}
 			break
 		}
@@ -187,21 +274,48 @@ func (ws *websocketImpl) readGoroutine() {
 	// Make sure the connecton is closed.  It is safe to call on a closed connection
 	ws.conn.Close()
 
-	// Make sure all other goroutines don't harass us any more
+	// Make sure all other goroutines don't harass us any more, and stop the write goroutine.  The
+	// channel is closed under the same lock that SendMessage holds while sending so a send can never
+	// race the close.
 	ws.runningLock.Lock()
 	ws.running = false
+	reason.Local = ws.closing
+	close(ws.sendChan)
 	ws.runningLock.Unlock()
 
-	// Stop the write goroutine
-	close(ws.sendChan)
+	// Tell someone that we're done, and why
+	log.Infof("ws: %s: %s", ws.userData, reason.Error())
+	ws.callbacks.OnClose(ws.userData, reason)
+}
+
+var errMessageTooBig = fmt.Errorf("message too big")
+
+// readMessage reads the next message, up to MaxMessageSize.  Anything bigger is thrown away and we
+// return errMessageTooBig, which leaves the websocket in one piece and ready for the next message.
+func (ws *websocketImpl) readMessage() ([]byte, error) {
+	_, r, err := ws.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r, ws.config.MaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(message)) > ws.config.MaxMessageSize {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooBig
+	}
 
-	// Tell someone that we're done
-	ws.callbacks.OnClose(ws.userData)
+	return message, nil
 }
 
 func (ws *websocketImpl) writeGoroutine() {
 
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(ws.config.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		ws.conn.Close()
@@ -210,37 +324,23 @@ func (ws *websocketImpl) writeGoroutine() {
 	for {
 		select {
 		case message, ok := <-ws.sendChan:
-			ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			ws.conn.SetWriteDeadline(time.Now().Add(ws.config.writeWait()))
 			if !ok {
 				log.Infof("ws: sendChan closed")
 				ws.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := ws.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Errorf("ws: next writer failed")
-				ws.callbacks.OnError(ws.userData, err)
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message.
-			n := len(ws.sendChan)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				message = <-ws.sendChan
-				w.Write(message)
-			}
-
-			if err := w.Close(); err != nil {
-				log.Errorf("ws: close on writer failed")
+			// One message per frame.  The players expect a single JSON array per message, so queued
+			// messages can't be glued together.
+			if err := ws.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Errorf("ws: write failed")
 				ws.callbacks.OnError(ws.userData, err)
 				return
 			}
 		case <-ticker.C:
 			log.Debugf("ws: %s: ping", ws.userData)
-			ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			ws.conn.SetWriteDeadline(time.Now().Add(ws.config.writeWait()))
 			if err := ws.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Errorf("ws: ping failed")
 				ws.callbacks.OnError(ws.userData, err)
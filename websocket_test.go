@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	sonos "github.com/swmerc/sonosmqtt/sonos"
+)
+
+// recordingCallbacks keeps everything a websocket tells us
+type recordingCallbacks struct {
+	sync.Mutex
+	messages []string
+	errors   []error
+	closed   bool
+	reason   CloseReason
+}
+
+func (c *recordingCallbacks) OnConnect(userData string) {}
+
+func (c *recordingCallbacks) OnMessage(userData string, msg []byte) {
+	c.Lock()
+	c.messages = append(c.messages, string(msg))
+	c.Unlock()
+}
+
+func (c *recordingCallbacks) OnClose(userData string, reason CloseReason) {
+	c.Lock()
+	c.closed = true
+	c.reason = reason
+	c.Unlock()
+}
+
+func (c *recordingCallbacks) OnError(userData string, err error) {
+	c.Lock()
+	c.errors = append(c.errors, err)
+	c.Unlock()
+}
+
+func TestWebsocketMaxMessageSize(t *testing.T) {
+	defer func(config WebsocketConfig) { websocketConfig = config }(websocketConfig)
+	websocketConfig.MaxMessageSize = 1024
+
+	// The server sends something too big, then something that fits
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 4096)))
+		conn.WriteMessage(websocket.TextMessage, []byte(`["small"]`))
+
+		// Hang around until the client is done with us
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	callbacks := &recordingCallbacks{}
+	ws := NewClientWebSocket("wss"+strings.TrimPrefix(server.URL, "https"), "test", http.Header{}, callbacks)
+	if !ws.IsRunning() {
+		t.Fatalf("websocket did not connect")
+	}
+	defer ws.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		callbacks.Lock()
+		messages, errors, closed := callbacks.messages, callbacks.errors, callbacks.closed
+		callbacks.Unlock()
+
+		if len(messages) > 0 {
+			if len(messages) != 1 || messages[0] != `["small"]` || len(errors) != 0 || closed {
+				t.Errorf("bogus result: messages=%v, errors=%v, closed=%t", messages, errors, closed)
+			}
+			break
+		}
+
+		if closed || len(errors) != 0 || time.Now().After(deadline) {
+			t.Fatalf("big message took the websocket down: errors=%v, closed=%t", errors, closed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebsocketOneMessagePerFrame(t *testing.T) {
+	frames := make(chan []byte, 8)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}))
+	defer server.Close()
+
+	ws := NewClientWebSocket("wss"+strings.TrimPrefix(server.URL, "https"), "test", http.Header{}, &recordingCallbacks{})
+	if !ws.IsRunning() {
+		t.Fatalf("websocket did not connect")
+	}
+	defer ws.Close()
+
+	// Back to back, so both are queued before the writer gets to them
+	for _, command := range []string{"getVolume", "getPlaybackStatus"} {
+		request := sonos.WebsocketRequest{}
+		request.Headers.Command = command
+		body, _ := request.ToRawBytes()
+		if err := ws.SendMessage(body); err != nil {
+			t.Fatalf("send failed: %s", err.Error())
+		}
+	}
+
+	for _, command := range []string{"getVolume", "getPlaybackStatus"} {
+		select {
+		case frame := <-frames:
+			request := sonos.WebsocketRequest{}
+			if err := request.FromRawBytes(frame); err != nil || request.Headers.Command != command {
+				t.Errorf("bogus frame: %s", string(frame))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no frame for %s", command)
+		}
+	}
+}
+
+func TestWebsocketCloseReason(t *testing.T) {
+	// Hang up like a player that is about to reboot, unless told to wait for the client to do it
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		if r.URL.Path == "/reboot" {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "rebooting"))
+		}
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	waitForClose := func(callbacks *recordingCallbacks) CloseReason {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			callbacks.Lock()
+			closed, reason := callbacks.closed, callbacks.reason
+			callbacks.Unlock()
+			if closed {
+				return reason
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("websocket never closed")
+		return CloseReason{}
+	}
+
+	url := "wss" + strings.TrimPrefix(server.URL, "https")
+
+	callbacks := &recordingCallbacks{}
+	NewClientWebSocket(url+"/reboot", "test", http.Header{}, callbacks)
+	if reason := waitForClose(callbacks); reason.Local || reason.Code != websocket.CloseGoingAway || !reason.IsNormal() {
+		t.Errorf("bogus reason for a reboot: %+v", reason)
+	}
+
+	callbacks = &recordingCallbacks{}
+	ws := NewClientWebSocket(url+"/wait", "test", http.Header{}, callbacks)
+	ws.Close()
+	if reason := waitForClose(callbacks); !reason.Local || reason.IsNormal() {
+		t.Errorf("bogus reason for our own close: %+v", reason)
+	}
+}